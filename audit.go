@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+const (
+	REVISIONS_LOG = "revisions.log"
+
+	REVISION_DEPLOYED    = "deployed"
+	REVISION_ROLLED_BACK = "rolled_back"
+)
+
+// revisionEntry is a line of revisions.log: a timestamp, the event and
+// key=value fields. In an audit it stands for the same line on all Hosts.
+type revisionEntry struct {
+	Time   time.Time
+	Event  string
+	Fields map[string]string
+	Hosts  []string
+}
+
+func pathRevisionsLog() string {
+	return filepath.Join(deployTo, REVISIONS_LOG)
+}
+
+func revisionLine(event, branch, rev, release string) string {
+	return fmt.Sprintf("%s %s branch=%s revision=%s release=%s user=%s from=%s",
+		time.Now().UTC().Format(time.RFC3339), event, branch, rev, release, deployUser(), localhost)
+}
+
+// logRevision appends line to revisions.log in deploy_to on conn's host.
+func logRevision(conn Executor, line string) {
+	conn.Run(Sh("echo", line).AppendTo(pathRevisionsLog()))
+	if conn.Err() != nil {
+		LogError(conn.Host(), fmt.Errorf("%s: %s", REVISIONS_LOG, conn.Err()))
+	}
+}
+
+func parseRevisionLine(line string) (*revisionEntry, bool) {
+	words := strings.Fields(line)
+	if len(words) < 2 {
+		return nil, false
+	}
+	t, err := time.Parse(time.RFC3339, words[0])
+	if err != nil {
+		return nil, false
+	}
+	e := &revisionEntry{Time: t, Event: words[1], Fields: map[string]string{}}
+	for _, w := range words[2:] {
+		if kv := strings.SplitN(w, "=", 2); len(kv) == 2 {
+			e.Fields[kv[0]] = kv[1]
+		}
+	}
+	return e, true
+}
+
+// fetchRevisions reads revisions.log on the host of s. A missing log has no
+// entries.
+func fetchRevisions(ctx context.Context, s server) ([]*revisionEntry, error) {
+	conn := newExecutor(ctx, s)
+	defer conn.Close()
+
+	if !conn.Exists(pathRevisionsLog()) {
+		return nil, conn.Err()
+	}
+	out := conn.Output(Sh("cat", pathRevisionsLog()))
+	if conn.Err() != nil {
+		return nil, conn.Err()
+	}
+
+	entries := []*revisionEntry{}
+	for _, line := range strings.Split(out, "\n") {
+		if e, ok := parseRevisionLine(line); ok {
+			entries = append(entries, e)
+		} else if strings.TrimSpace(line) != "" {
+			LogDebug(s.Host, fmt.Sprintf("%s: skipping %q", REVISIONS_LOG, line))
+		}
+	}
+	return entries, nil
+}
+
+// mergeRevisions folds the entries of all hosts into one list in time
+// order, where the same event of a deploy on several hosts is one entry.
+func mergeRevisions(byHost map[string][]*revisionEntry) []*revisionEntry {
+	hosts := make([]string, 0, len(byHost))
+	for h := range byHost {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+
+	merged := map[string]*revisionEntry{}
+	for _, h := range hosts {
+		for _, e := range byHost[h] {
+			key := strings.Join([]string{e.Event, e.Fields["release"], e.Fields["revision"], e.Fields["user"], e.Fields["from"]}, " ")
+			m, ok := merged[key]
+			if !ok {
+				m = &revisionEntry{Time: e.Time, Event: e.Event, Fields: e.Fields}
+				merged[key] = m
+			}
+			if e.Time.Before(m.Time) {
+				m.Time = e.Time
+			}
+			m.Hosts = append(m.Hosts, h)
+		}
+	}
+
+	ret := make([]*revisionEntry, 0, len(merged))
+	for _, m := range merged {
+		ret = append(ret, m)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].Time.Equal(ret[j].Time) {
+			return ret[i].Time.Before(ret[j].Time)
+		}
+		return ret[i].Event < ret[j].Event
+	})
+	return ret
+}
+
+func capAudit(c *cli.Context) error {
+	if err := setupStage(c); err != nil {
+		return err
+	}
+
+	ctx, cancel := deployContext()
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	byHost := map[string][]*revisionEntry{}
+	failed := 0
+	wg.Add(len(config.Servers))
+	for _, v := range config.Servers {
+		go func(s server) {
+			defer wg.Done()
+			entries, err := fetchRevisions(ctx, s)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				LogError(s.Host, err)
+				failed++
+				return
+			}
+			byHost[s.Host] = entries
+		}(v)
+	}
+	wg.Wait()
+
+	rows := [][]string{}
+	for _, e := range mergeRevisions(byHost) {
+		rev := e.Fields["revision"]
+		if len(rev) > 7 {
+			rev = rev[:7]
+		}
+		hosts := strings.Join(e.Hosts, ",")
+		if len(e.Hosts) == len(config.Servers) {
+			hosts = "all"
+		}
+		rows = append(rows, []string{
+			e.Time.Local().Format(time.RFC3339),
+			strings.Replace(e.Event, "_", " ", -1),
+			e.Fields["branch"],
+			rev,
+			e.Fields["release"],
+			e.Fields["user"],
+			e.Fields["from"],
+			hosts,
+		})
+	}
+	LogTable("revision", []string{"DATE", "EVENT", "BRANCH", "REVISION", "RELEASE", "USER", "FROM", "HOSTS"}, rows)
+
+	if failed > 0 {
+		return exitError(hostsExitCode(len(config.Servers), failed, 0, 0),
+			fmt.Errorf("could not read %s on %d of %d servers", REVISIONS_LOG, failed, len(config.Servers)))
+	}
+	return nil
+}
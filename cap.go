@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
@@ -27,17 +28,39 @@ var (
 	sharedFiles,
 	writableDirs []string
 
+	commandTimeout,
+	deployTimeout,
+	dialTimeout time.Duration
+
 	env map[string]string
 )
 
-func setup(stage string) {
-	config = newConfig(stage)
+const (
+	DEFAULT_COMMAND_TIMEOUT = 20 * time.Minute
+	DEFAULT_DEPLOY_TIMEOUT = time.Hour
+	DEFAULT_SSH_TIMEOUT = 30 * time.Second
+)
+
+func setup(stage string) error {
+	logStage = stage
+
+	var err error
+	config, err = newConfig(stage)
+	if err != nil {
+		return err
+	}
 
-	fmt.Printf("config.Servers = %+v\n", config.Servers)
-	//logLevel = LOG_TRACE
 	logLevel = config.LogLevel
+	if logLevelFlag != 0 {
+		logLevel = logLevelFlag
+	}
 
-	cachedCopy = config.DeployCachedCopy
+	// resolved once so every git command sees the same cached copy. Left
+	// empty when unset, which the git helpers refuse.
+	cachedCopy = ""
+	if config.DeployCachedCopy != "" {
+		cachedCopy, _ = filepath.Abs(config.DeployCachedCopy)
+	}
 	deployTo = config.DeployTo
 	releasesPath = filepath.Join(deployTo, "releases")
 	sharedPath = filepath.Join(deployTo, "shared")
@@ -46,113 +69,244 @@ func setup(stage string) {
 	sharedDirs = config.SharedDirs
 	sharedFiles = config.SharedFiles
 	writableDirs = config.WritableDirs
+
+	commandTimeout = parseTimeout("command_timeout", config.CommandTimeout, DEFAULT_COMMAND_TIMEOUT)
+	deployTimeout = parseTimeout("deploy_timeout", config.DeployTimeout, DEFAULT_DEPLOY_TIMEOUT)
+	dialTimeout = parseTimeout("ssh_timeout", config.SSHTimeout, DEFAULT_SSH_TIMEOUT)
+	return nil
+}
+
+// setupStage loads the config of the selected stage. An invalid config
+// exits with EXIT_CONFIG.
+func setupStage(c *cli.Context) error {
+	if err := setup(c.GlobalString("stage")); err != nil {
+		return exitError(EXIT_CONFIG, err)
+	}
+	return nil
+}
+
+func parseTimeout(name, s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		LogError(localhost, fmt.Errorf("%s: %s, using %s", name, err, def))
+		return def
+	}
+	return d
 }
 
-func capInit(c *cli.Context) {
-	setup(c.GlobalString("stage"))
+// deployContext bounds a whole command run by deploy_timeout.
+func deployContext() (context.Context, context.CancelFunc) {
+	if deployTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), deployTimeout)
+}
+
+func capInit(c *cli.Context) error {
+	if err := setupStage(c); err != nil {
+		return err
+	}
 	Log("not implemented")
+	return nil
 }
 
-func capDeploy(c *cli.Context) {
-	setup(c.GlobalString("stage"))
+func capDeploy(c *cli.Context) (err error) {
+	if err := setupStage(c); err != nil {
+		return err
+	}
 	if len(config.Servers) == 0 {
-		return
+		return nil
+	}
+
+	reportFile := c.String("report-file")
+	format, err := reportFormat(reportFile, c.String("report-format"))
+	if err != nil {
+		return err
 	}
 
 	ts := time.Now().Local().Format("20060102150405")
-	var rev string
-	var err error
+	tracePath, err := openTrace(c.GlobalString("stage"), ts)
+	if err != nil {
+		LogError(localhost, fmt.Errorf("deploy log: %s", err))
+	} else {
+		defer func() {
+			closeTrace()
+			Log(fmt.Sprintf("Deploy log written to %s", tracePath))
+		}()
+	}
+
+	r := startReport(c.GlobalString("stage"), config.GitBranch, ts, config.Servers)
+	defer func() {
+		r.finish()
+		LogReport(r)
+		path, err := historyPath()
+		if err == nil {
+			err = recordHistory(path, r)
+		}
+		if err != nil {
+			LogError(localhost, fmt.Errorf("history: %s", err))
+		}
+		if reportFile == "" {
+			return
+		}
+		if err := writeReport(r, reportFile, format); err != nil {
+			LogError(localhost, fmt.Errorf("report: %s", err))
+		}
+	}()
+	// the summary has told what failed
+	defer func() {
+		if code := r.exitCode(); code != EXIT_OK && err == nil {
+			err = exitError(code, nil)
+		}
+	}()
+
+	ctx, cancel := deployContext()
+	defer cancel()
+	stopSignals := handleInterrupt()
+	defer stopSignals()
 
-	rev, err = updateSrc(branch)
-	src, err := syncSrc()
+	rev, err := updateSrc(ctx, config.GitBranch)
+	if err != nil {
+		return nil
+	}
+	r.Revision = rev
+	// src is set even when the copy failed, so that it is removed
+	src, err := syncSrc(ctx)
 	defer os.RemoveAll(src)
 	if err != nil {
-		LogError(localhost, err)
-		return
+		return nil
 	}
+	r.buildDone()
 
 	var wg sync.WaitGroup
 	wg.Add(len(config.Servers))
 
 	for _, v := range config.Servers {
-		LogInfo(v.Host, "##### Start deploy ##### \n")
+		LogHost(v.Host, "##### Start deploy ##### \n")
 		go func(s server) {
 			defer wg.Done()
-			err := syncDest(s, src)
-			if err != nil {
-				return
+			conn := newExecutor(ctx, s)
+			defer conn.Close()
+			connected := conn.Err() == nil
+			if !connected {
+				LogError(s.Host, conn.Err())
+				r.hostUnreachable(s.Host)
 			}
 
-			conn := newConnection(s)
+			syncDest(conn, src)
 			release := finalizeUpdate(conn, ts, rev)
 			Symfony(conn, release)
-			createSymlink(conn, release)
-
-			if conn.Err != nil {
-				conn.Err = nil
-				LogInfo(s.Host, "Roleback\n")
-				conn.Exec("rm", "-Rf", release)
+			switched := createSymlink(conn, release)
+
+			// once current points at the release it must stay, even if
+			// pruning old releases failed
+			err := conn.Err()
+			rolledBack := false
+			if err != nil && !switched && release != "" {
+				rolledBack = rollback(conn, release)
+			}
+			r.finishHost(s.Host, err, rolledBack)
+			switch {
+			case err == nil:
+				logRevision(conn, revisionLine(REVISION_DEPLOYED, config.GitBranch, rev, ts))
+			case rolledBack:
+				logRevision(conn, revisionLine(REVISION_ROLLED_BACK, config.GitBranch, rev, ts))
+			}
+			if connected {
+				uploadTrace(conn, ts)
 			}
 		}(v)
 	}
 	wg.Wait()
+	return nil
 }
 
-func capSetup(c *cli.Context) {
-	setup(c.GlobalString("stage"))
+func capSetup(c *cli.Context) error {
+	if err := setupStage(c); err != nil {
+		return err
+	}
 	if len(config.Servers) == 0 {
-		return
+		return nil
 	}
 
+	ctx, cancel := deployContext()
+	defer cancel()
+
+	var mu sync.Mutex
+	failed, unreachable := 0, 0
 	var wg sync.WaitGroup
 	wg.Add(len(config.Servers))
 
 	for _, v := range config.Servers {
-		LogInfo(v.Host, "-----> Start deploy setup \n")
+		LogHost(v.Host, "-----> Start deploy setup \n")
 		go func(s server) {
 			defer wg.Done()
-			conn := newConnection(s)
-
-			conn.Exec("mkdir", "-p", deployTo, releasesPath, sharedPath)
-			conn.Exec("chmod", "g+w", deployTo, releasesPath, sharedPath)
-			lenText := LogInfo(s.Host, "Creates dirs of deploy, releases, shared")
-			if conn.Err != nil {
-				LogNG(lenText)
-				LogError(s.Host, conn.Err)
-				return
+			conn := newExecutor(ctx, s)
+			defer conn.Close()
+			reachable := conn.Err() == nil
+
+			step := LogInfo(s.Host, "Creates dirs of deploy, releases, shared")
+			conn.Run(Sh("mkdir", "-p", deployTo, releasesPath, sharedPath))
+			conn.Run(Sh("chmod", "g+w", deployTo, releasesPath, sharedPath))
+			if conn.Err() != nil {
+				LogNG(step)
+				LogError(s.Host, conn.Err())
+			} else {
+				LogOK(step)
+				SymfonySetup(conn)
+			}
+
+			if conn.Err() != nil {
+				mu.Lock()
+				failed++
+				if !reachable {
+					unreachable++
+				}
+				mu.Unlock()
 			}
-			LogOK(lenText)
-			SymfonySetup(conn)
 		}(v)
 	}
 	wg.Wait()
+
+	if code := hostsExitCode(len(config.Servers), failed, unreachable, 0); code != EXIT_OK {
+		return exitError(code, fmt.Errorf("setup failed on %d of %d servers", failed, len(config.Servers)))
+	}
+	return nil
 }
 
 
-func updateSrc(branch string) (string, error) {
+func updateSrc(ctx context.Context, branch string) (string, error) {
 	if IsExist(cachedCopy) {
-		return GitSync(branch)
+		return GitSync(ctx, cachedCopy, branch)
 	} else {
-		return GitCheckout(branch)
+		return GitCheckout(ctx, config.GitRepoURL, cachedCopy, branch)
 	}
 }
 
-func syncSrc() (dst string, err error) {
-	cli := &Cmd{}
+// syncSrc copies the source to deploy into a temp dir. It returns the temp
+// dir even on error, and the caller removes it.
+func syncSrc(ctx context.Context) (dst string, err error) {
+	cli := &Cmd{ctx: ctx}
+	step := LogInfo(localhost, "Update local src")
 	defer func() {
-		lenText := LogInfo(localhost, "Update local src")
 		if cli.err != nil {
-			LogNG(lenText)
+			LogNG(step)
 			LogError(localhost, cli.err)
-			dst = ""
 			err = cli.err
 			return
 		}
-		LogOK(lenText)
+		LogOK(step)
 	}()
 
 	src := filepath.Join(cachedCopy, config.DeploySubdir)
 	dst, cli.err = TempDir()
+	if cli.err == nil {
+		tmp := dst
+		atForceExit(func() { os.RemoveAll(tmp) })
+	}
 
 	args := []string{"-lrpta"}
 	copyExclude := config.DeoloyExclude
@@ -165,29 +319,28 @@ func syncSrc() (dst string, err error) {
 		args = append(args, src + "/", dst)
 		cli.Exec("rsync", args...)
 	} else {
-		cli.Exec("cp", "-RPp", src, dst)
+		cli.Exec("cp", "-RPp", src+"/.", dst)
 	}
 
 	return dst, nil
 }
 
-func syncDest(s server, src string) (err error) {
-	cli := &Cmd{}
+func syncDest(conn Executor, src string) {
+	if conn.Err() != nil {
+		return
+	}
+
+	step := LogInfo(conn.Host(), fmt.Sprintf("Upload from [%s] to [%s]", localhost, conn.Host()))
 	defer func() {
-		lenText := LogInfo(s.Host, fmt.Sprintf("Rsync from [%s] to [%s]", localhost, s.Host))
-		if cli.err != nil {
-			LogNG(lenText)
-			LogError(s.Host, cli.err)
-			err = cli.err
+		if conn.Err() != nil {
+			LogNG(step)
+			LogError(conn.Host(), conn.Err())
 			return
 		}
-		LogOK(lenText)
+		LogOK(step)
 	}()
 
-	remoteSrc := fmt.Sprintf("%s@%s:%s", s.User, s.Host, filepath.Join(sharedPath, "cached-copy"))
-	cli.Exec("rsync", "-lrptauz", "--delete", "-e", "ssh", src + "/", remoteSrc)
-
-	return nil
+	conn.Upload(src, pathCached())
 }
 
 func pathCached() string {
@@ -202,76 +355,92 @@ func pathCurrent() string {
 	return filepath.Join(deployTo, "current")
 }
 
-func finalizeUpdate(conn *SshConnection, ts, rev string) string {
-	if conn.Err != nil {
+// finalizeUpdate creates release ts from the cached copy and links the shared
+// dirs and files into it. It returns the release once the copy has started,
+// even when a step failed, and "" when nothing was created.
+func finalizeUpdate(conn Executor, ts, rev string) string {
+	if conn.Err() != nil {
 		return ""
 	}
 
 	src := pathCached()
 	release := pathRelease(ts)
 
-	conn.Exec("cp", "-RPp", src, release)
-	conn.Exec("echo", rev, ">", filepath.Join(release, "REVISION"))
-	conn.Exec("chmod", "-R", "g+w", release)
-
-	lenText := LogInfo(conn.Host.Host, "Create latest release")
-	if conn.Err != nil {
-		LogNG(lenText)
-		LogError(conn.Host.Host, conn.Err)
-		return ""
+	step := LogInfo(conn.Host(), "Create latest release")
+	conn.Run(Sh("cp", "-RPp", src, release))
+	conn.Run(Sh("echo", rev).To(filepath.Join(release, "REVISION")))
+	conn.Run(Sh("chmod", "-R", "g+w", release))
+	if conn.Err() != nil {
+		LogNG(step)
+		LogError(conn.Host(), conn.Err())
+		return release
 	}
-	LogOK(lenText)
+	LogOK(step)
 
+	step = LogInfo(conn.Host(), "Symlinks static directories and static files")
+	// the parents of the links may not be in the repo
 	for _, v := range sharedDirs {
-		conn.Exec("mkdir", "-p", filepath.Join(sharedPath, v))
-		conn.Exec(fmt.Sprintf(
-			"sh -c 'if [ -d %s/%s ] ; then rm -rf %s/%s; fi'",
-			release,
-			v,
-			release,
-			v,
-		))
-		conn.Exec("ln", "-nfs", filepath.Join(sharedPath, v), filepath.Join(release,v))
+		conn.Run(Sh("mkdir", "-p", filepath.Join(sharedPath, v), filepath.Join(release, path.Dir(v))))
+		dir := filepath.Join(release, v)
+		conn.Run(Sh("test", "!", "-d", dir).Or("rm", "-rf", dir))
+		conn.Run(Sh("ln", "-nfs", filepath.Join(sharedPath, v), filepath.Join(release,v)))
 	}
 
 	for _, v := range sharedFiles {
-		conn.Exec("mkdir", "-p", filepath.Join(sharedPath, path.Dir(v)))
-		conn.Exec("touch", filepath.Join(sharedPath, v))
-		conn.Exec("ln", "-nfs", filepath.Join(sharedPath, v), filepath.Join(release,v))
+		conn.Run(Sh("mkdir", "-p", filepath.Join(sharedPath, path.Dir(v)), filepath.Join(release, path.Dir(v))))
+		conn.Run(Sh("touch", filepath.Join(sharedPath, v)))
+		conn.Run(Sh("ln", "-nfs", filepath.Join(sharedPath, v), filepath.Join(release,v)))
 	}
 
-	lenText = LogInfo(conn.Host.Host, "Symlinks static directories and static files")
-	if conn.Err != nil {
-		LogNG(lenText)
-		LogError(conn.Host.Host, conn.Err)
-		return ""
+	if conn.Err() != nil {
+		LogNG(step)
+		LogError(conn.Host(), conn.Err())
+		return release
 	}
-	LogOK(lenText)
+	LogOK(step)
 
 	return release
 }
 
-func createSymlink(conn *SshConnection, dst string) {
-	if conn.Err != nil {
-		return
+// createSymlink points current at dst and prunes old releases. It reports
+// whether current was switched.
+func createSymlink(conn Executor, dst string) (switched bool) {
+	if conn.Err() != nil {
+		return false
 	}
 
+	step := LogInfo(conn.Host(), "Updates latest release")
 	defer func() {
-		lenText := LogInfo(conn.Host.Host, "Updates latest release")
-		if conn.Err != nil {
-			LogNG(lenText)
-			LogError(conn.Host.Host, conn.Err)
+		if conn.Err() != nil {
+			LogNG(step)
+			LogError(conn.Host(), conn.Err())
 			return
 		}
-		LogOK(lenText)
+		LogOK(step)
 	}()
 
 	cur := pathCurrent()
 
-	conn.Exec("rm", "-f", cur, "&&", "ln", "-vs", dst, cur)
-	conn.Exec(
-		"ls", "-1dt", filepath.Join(releasesPath, "*"),
-		" | ", "tail", "-n", fmt.Sprintf("+%d", config.DeployKeepReleases + 1),
-		" | ", "xargs", "rm", "-rf",
+	conn.Run(Sh("rm", "-f", cur).And("ln", "-vs", dst, cur))
+	switched = conn.Err() == nil
+	conn.Run(
+		Sh("ls", "-1dt").Raw(ShellQuote(releasesPath) + "/*").
+			Pipe("tail", "-n", fmt.Sprintf("+%d", config.DeployKeepReleases+1)).
+			Pipe("xargs", "rm", "-rf"),
 	)
+	return switched
+}
+
+// rollback removes a release that failed to deploy and reports whether it
+// could. It runs outside the deploy deadline and after an interrupt, either
+// of which may be what made the deploy fail. A release the failed copy did
+// not create is not rolled back.
+func rollback(conn Executor, release string) bool {
+	conn.Reset()
+	if !conn.Exists(release) {
+		return false
+	}
+	LogHost(conn.Host(), "Roleback\n")
+	conn.Run(Sh("rm", "-Rf", release))
+	return conn.Err() == nil
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testConfig sets the globals of setup for a deploy to /srv/app.
+func testConfig() {
+	logLevel = LOG_CRIT
+	config = &Config{
+		ConfigApp:    &ConfigApp{},
+		ConfigServer: &ConfigServer{},
+		ConfigDeploy: &ConfigDeploy{DeployKeepReleases: 2},
+	}
+	deployTo = "/srv/app"
+	releasesPath = "/srv/app/releases"
+	sharedPath = "/srv/app/shared"
+	webUser = "www-data"
+	sharedDirs = nil
+	sharedFiles = nil
+	writableDirs = nil
+}
+
+func TestFinalizeUpdate(t *testing.T) {
+	const rel = "/srv/app/releases/20240102030405"
+	create := []string{
+		"cp -RPp /srv/app/shared/cached-copy " + rel,
+		"echo abc123 > " + rel + "/REVISION",
+		"chmod -R g+w " + rel,
+	}
+
+	for _, tt := range []struct {
+		name        string
+		sharedDirs  []string
+		sharedFiles []string
+		errors      map[string]error
+		want        []string
+		release     string
+	}{
+		{
+			name:    "no shared",
+			want:    create,
+			release: rel,
+		},
+		{
+			name:        "shared dirs and files",
+			sharedDirs:  []string{"app/logs", "web/my uploads"},
+			sharedFiles: []string{"app/config/parameters.yml"},
+			want: append(append([]string{}, create...),
+				"mkdir -p /srv/app/shared/app/logs "+rel+"/app",
+				"test '!' -d "+rel+"/app/logs || rm -rf "+rel+"/app/logs",
+				"ln -nfs /srv/app/shared/app/logs "+rel+"/app/logs",
+				"mkdir -p '/srv/app/shared/web/my uploads' "+rel+"/web",
+				"test '!' -d '"+rel+"/web/my uploads' || rm -rf '"+rel+"/web/my uploads'",
+				"ln -nfs '/srv/app/shared/web/my uploads' '"+rel+"/web/my uploads'",
+				"mkdir -p /srv/app/shared/app/config "+rel+"/app/config",
+				"touch /srv/app/shared/app/config/parameters.yml",
+				"ln -nfs /srv/app/shared/app/config/parameters.yml "+rel+"/app/config/parameters.yml",
+			),
+			release: rel,
+		},
+		{
+			name:       "copy fails",
+			sharedDirs: []string{"app/logs"},
+			errors:     map[string]error{create[0]: exitStatus(1)},
+			want:       create[:1],
+			release:    rel,
+		},
+		{
+			name:       "shared dir fails",
+			sharedDirs: []string{"app/logs"},
+			errors:     map[string]error{"mkdir -p /srv/app/shared/app/logs " + rel + "/app": exitStatus(1)},
+			want:       append(append([]string{}, create...), "mkdir -p /srv/app/shared/app/logs "+rel+"/app"),
+			release:    rel,
+		},
+	} {
+		testConfig()
+		sharedDirs = tt.sharedDirs
+		sharedFiles = tt.sharedFiles
+		r := &RecordingExecutor{Name: "web1", Errors: tt.errors}
+
+		release := finalizeUpdate(r, "20240102030405", "abc123")
+		if release != tt.release {
+			t.Errorf("%s: release = %q, want %q", tt.name, release, tt.release)
+		}
+		if !reflect.DeepEqual(r.Commands, tt.want) {
+			t.Errorf("%s: commands\n got %q\nwant %q", tt.name, r.Commands, tt.want)
+		}
+	}
+}
+
+func TestFinalizeUpdateAfterError(t *testing.T) {
+	testConfig()
+	r := &RecordingExecutor{Name: "web1"}
+	r.SetErr(errors.New("upload failed"))
+	if release := finalizeUpdate(r, "20240102030405", "abc123"); release != "" || len(r.Commands) > 0 {
+		t.Errorf("ran %q after an error", r.Commands)
+	}
+}
+
+func TestCreateSymlink(t *testing.T) {
+	const rel = "/srv/app/releases/20240102030405"
+	link := "rm -f /srv/app/current && ln -vs " + rel + " /srv/app/current"
+	prune := "ls -1dt /srv/app/releases/* | tail -n +3 | xargs rm -rf"
+
+	for _, tt := range []struct {
+		name     string
+		keep     int
+		errors   map[string]error
+		want     []string
+		switched bool
+		err      bool
+	}{
+		{"switch and prune", 2, nil, []string{link, prune}, true, false},
+		{"keep 5", 5, nil, []string{link, "ls -1dt /srv/app/releases/* | tail -n +6 | xargs rm -rf"}, true, false},
+		{"link fails", 2, map[string]error{link: exitStatus(1)}, []string{link}, false, true},
+		{"prune fails", 2, map[string]error{prune: exitStatus(123)}, []string{link, prune}, true, true},
+	} {
+		testConfig()
+		config.DeployKeepReleases = tt.keep
+		r := &RecordingExecutor{Name: "web1", Errors: tt.errors}
+
+		switched := createSymlink(r, rel)
+		if switched != tt.switched {
+			t.Errorf("%s: switched = %v, want %v", tt.name, switched, tt.switched)
+		}
+		if (r.Err() != nil) != tt.err {
+			t.Errorf("%s: Err = %v", tt.name, r.Err())
+		}
+		if !reflect.DeepEqual(r.Commands, tt.want) {
+			t.Errorf("%s: commands\n got %q\nwant %q", tt.name, r.Commands, tt.want)
+		}
+	}
+}
+
+func TestRollback(t *testing.T) {
+	const rel = "/srv/app/releases/20240102030405"
+	exists := "test -e " + rel
+
+	for _, tt := range []struct {
+		name       string
+		errors     map[string]error
+		want       []string
+		rolledBack bool
+	}{
+		{"release created", nil, []string{exists, "rm -Rf " + rel}, true},
+		{"release not created", map[string]error{exists: exitStatus(1)}, []string{exists}, false},
+		{"remove fails", map[string]error{"rm -Rf " + rel: exitStatus(1)}, []string{exists, "rm -Rf " + rel}, false},
+	} {
+		testConfig()
+		r := &RecordingExecutor{Name: "web1", Errors: tt.errors}
+		r.SetErr(errors.New("composer failed"))
+
+		if rolledBack := rollback(r, rel); rolledBack != tt.rolledBack {
+			t.Errorf("%s: rolled back = %v, want %v", tt.name, rolledBack, tt.rolledBack)
+		}
+		if !reflect.DeepEqual(r.Commands, tt.want) {
+			t.Errorf("%s: commands\n got %q\nwant %q", tt.name, r.Commands, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/codegangsta/cli"
+)
+
+const (
+	// DEFAULT_MIN_FREE_SPACE is the free space in MB required on deploy_to
+	// when deploy_min_free_space is not configured.
+	DEFAULT_MIN_FREE_SPACE = 512
+
+	CHECK_CONNECT = "Connect and authenticate"
+)
+
+// NOT_FOUND_STATUS are the exit statuses of command -v for a missing
+// command: 1 in bash, 127 in dash.
+var NOT_FOUND_STATUS = []int{1, 127}
+
+type checkResult struct {
+	Name string
+	Err  error
+}
+
+type hostCheck struct {
+	Host    string
+	Results []checkResult
+}
+
+func (h *hostCheck) add(name string, err error) {
+	h.Results = append(h.Results, checkResult{Name: name, Err: err})
+}
+
+func (h *hostCheck) Failed() int {
+	n := 0
+	for _, r := range h.Results {
+		if r.Err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func capCheck(c *cli.Context) error {
+	if err := setupStage(c); err != nil {
+		return err
+	}
+
+	ctx, cancel := deployContext()
+	defer cancel()
+
+	local := checkLocal(ctx)
+	// the servers in config order
+	checks := make([]*hostCheck, len(config.Servers))
+
+	var wg sync.WaitGroup
+	wg.Add(len(config.Servers))
+
+	for i, v := range config.Servers {
+		go func(i int, s server) {
+			defer wg.Done()
+			checks[i] = checkServer(ctx, s)
+		}(i, v)
+	}
+	wg.Wait()
+
+	printHostCheck(local)
+	failed := 0
+	for _, hc := range checks {
+		printHostCheck(hc)
+		if hc.Failed() > 0 {
+			failed++
+		}
+	}
+
+	if code := checkExitCode(local, checks); code != EXIT_OK {
+		failures := []string{}
+		if local.Failed() > 0 {
+			failures = append(failures, localhost)
+		}
+		if failed > 0 {
+			failures = append(failures, fmt.Sprintf("%d of %d servers", failed, len(checks)))
+		}
+		return exitError(code, fmt.Errorf("%s failed the preflight check", strings.Join(failures, " and ")))
+	}
+	LogResult(fmt.Sprintf("%s and all %d servers passed the preflight check", localhost, len(checks)))
+	return nil
+}
+
+// checkExitCode is the exit status of cap check. Only servers count as
+// hosts; when this machine failed, nothing can be built to deploy.
+func checkExitCode(local *hostCheck, servers []*hostCheck) int {
+	if local.Failed() > 0 {
+		return EXIT_BUILD
+	}
+	failed, unreachable := 0, 0
+	for _, hc := range servers {
+		if hc.Failed() > 0 {
+			failed++
+		}
+		if hc.Unreachable() {
+			unreachable++
+		}
+	}
+	return hostsExitCode(len(servers), failed, unreachable, 0)
+}
+
+// Unreachable reports whether connecting to the host failed.
+func (h *hostCheck) Unreachable() bool {
+	for _, r := range h.Results {
+		if r.Name == CHECK_CONNECT {
+			return r.Err != nil
+		}
+	}
+	return false
+}
+
+func printHostCheck(hc *hostCheck) {
+	for _, r := range hc.Results {
+		LogCheck(hc.Host, r.Name, r.Err)
+	}
+}
+
+// checkLocal verifies the tools cap itself runs on this machine.
+func checkLocal(ctx context.Context) *hostCheck {
+	hc := &hostCheck{Host: localhost}
+	for _, bin := range localBins() {
+		_, err := CmdOutput(ctx, "", "sh", "-c", Sh("command", "-v", bin).String())
+		if IsExitStatus(err, NOT_FOUND_STATUS...) {
+			err = fmt.Errorf("%s not found in PATH", bin)
+		}
+		hc.add(fmt.Sprintf("Local binary %s", bin), err)
+	}
+	return hc
+}
+
+func checkServer(ctx context.Context, s server) *hostCheck {
+	hc := &hostCheck{Host: s.Host}
+
+	conn := newExecutor(ctx, s)
+	defer conn.Close()
+	hc.add(CHECK_CONNECT, conn.Err())
+	if conn.Err() != nil {
+		return hc
+	}
+
+	// remote runs c, which exits with one of codes when the check fails.
+	// Any other error, such as a dropped session or a timeout, is reported
+	// as it is.
+	remote := func(name, failure string, c *Command, codes ...int) {
+		conn.Run(c)
+		err := conn.Err()
+		conn.SetErr(nil)
+		if IsExitStatus(err, codes...) {
+			err = errors.New(failure)
+		}
+		hc.add(name, err)
+	}
+
+	remote("deploy_to is writable", deployTo+" is missing or not writable", Sh("test", "-w", deployTo), 1)
+	remote("releases exists", releasesPath+" is missing, run cap setup", Sh("test", "-d", releasesPath), 1)
+	remote("shared exists", sharedPath+" is missing, run cap setup", Sh("test", "-d", sharedPath), 1)
+
+	hc.add("Free disk space", checkFreeSpace(conn))
+
+	for _, bin := range serverBins(s) {
+		remote(fmt.Sprintf("Binary %s", bin), bin+" not found in PATH", Sh("command", "-v", bin), NOT_FOUND_STATUS...)
+	}
+
+	if s.WebUser != "" {
+		remote(fmt.Sprintf("web_user %s exists", s.WebUser), "no such user "+s.WebUser, Sh("id", "-u", s.WebUser), 1)
+	}
+
+	for _, v := range sharedDirs {
+		p := filepath.Join(sharedPath, v)
+		remote(fmt.Sprintf("Shared dir %s", v), p+" does not exist", Sh("test", "-d", p), 1)
+	}
+	for _, v := range sharedFiles {
+		p := filepath.Join(sharedPath, v)
+		remote(fmt.Sprintf("Shared file %s", v), p+" does not exist", Sh("test", "-f", p), 1)
+	}
+
+	return hc
+}
+
+// localBins are the commands a deploy runs on this machine: git, and rsync
+// to copy the src with deploy_exclude or to upload to a server over ssh.
+func localBins() []string {
+	bins := []string{"git"}
+	needRsync := len(config.DeoloyExclude) > 0
+	for _, s := range config.Servers {
+		if s.Transport != TRANSPORT_LOCAL {
+			needRsync = true
+		}
+	}
+	if needRsync {
+		bins = append(bins, "rsync")
+	}
+	return bins
+}
+
+// serverBins are the commands a deploy runs on s. Uploads to a server on
+// the local transport are plain copies, without rsync.
+func serverBins(s server) []string {
+	bins := []string{}
+	if s.Transport != TRANSPORT_LOCAL {
+		bins = append(bins, "rsync")
+	}
+	php := "php"
+	if s.PHPBin != "" {
+		php = s.PHPBin
+	}
+	bins = append(bins, php)
+	if len(writableDirs) > 0 {
+		bins = append(bins, "setfacl", "getfacl")
+	}
+	return bins
+}
+
+func checkFreeSpace(conn Executor) error {
+	min := config.DeployMinFreeSpace
+	if min == 0 {
+		min = DEFAULT_MIN_FREE_SPACE
+	}
+
+	out := conn.Output(Sh("df", "-Pk", deployTo).Pipe("tail", "-n", "1"))
+	if conn.Err() != nil {
+		err := conn.Err()
+		conn.SetErr(nil)
+		return err
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) < 4 {
+		return fmt.Errorf("unexpected df output: %s", out)
+	}
+	avail, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return fmt.Errorf("unexpected df output: %s", out)
+	}
+	if avail/1024 < min {
+		return fmt.Errorf("%d MB available on %s, %d MB required", avail/1024, deployTo, min)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestLocalBins(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		exclude []string
+		servers []server
+		want    []string
+	}{
+		{"ssh server", nil, []server{{Host: "web1"}}, []string{"git", "rsync"}},
+		{"local server", nil, []server{{Host: "web1", Transport: TRANSPORT_LOCAL}}, []string{"git"}},
+		{"local server and exclude", []string{"tests"}, []server{{Host: "web1", Transport: TRANSPORT_LOCAL}}, []string{"git", "rsync"}},
+		{"local and ssh servers", nil, []server{{Host: "web1", Transport: TRANSPORT_LOCAL}, {Host: "web2", Transport: TRANSPORT_SSH}}, []string{"git", "rsync"}},
+	} {
+		testConfig()
+		config.DeoloyExclude = tt.exclude
+		config.Servers = tt.servers
+		if got := localBins(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestServerBins(t *testing.T) {
+	testConfig()
+	if got, want := serverBins(server{Host: "web1"}), []string{"rsync", "php"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ssh: %q, want %q", got, want)
+	}
+	writableDirs = []string{"app/cache"}
+	got := serverBins(server{Host: "web1", Transport: TRANSPORT_LOCAL, PHPBin: "php7"})
+	if want := []string{"php7", "setfacl", "getfacl"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("local: %q, want %q", got, want)
+	}
+}
+
+func TestCheckExitCode(t *testing.T) {
+	ok := func(host string) *hostCheck {
+		hc := &hostCheck{Host: host}
+		hc.add(CHECK_CONNECT, nil)
+		return hc
+	}
+	failed := func(host, name string) *hostCheck {
+		hc := &hostCheck{Host: host}
+		hc.add(name, errors.New("failed"))
+		return hc
+	}
+	badLocal := &hostCheck{Host: localhost}
+	badLocal.add("Local binary rsync", errors.New("rsync not found in PATH"))
+
+	for _, tt := range []struct {
+		name    string
+		local   *hostCheck
+		servers []*hostCheck
+		want    int
+	}{
+		{"all pass", &hostCheck{Host: localhost}, []*hostCheck{ok("web1"), ok("web2")}, EXIT_OK},
+		{"local fails", badLocal, []*hostCheck{ok("web1"), ok("web2")}, EXIT_BUILD},
+		{"one server fails", &hostCheck{Host: localhost}, []*hostCheck{ok("web1"), failed("web2", "Binary php")}, EXIT_PARTIAL},
+		{"all servers fail", &hostCheck{Host: localhost}, []*hostCheck{failed("web1", "Binary php")}, EXIT_FAILED},
+		{"unreachable", &hostCheck{Host: localhost}, []*hostCheck{failed("web1", CHECK_CONNECT)}, EXIT_CONNECT},
+	} {
+		if got := checkExitCode(tt.local, tt.servers); got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
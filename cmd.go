@@ -1,17 +1,36 @@
 package main
 
 import (
-	"bytes"
-	"errors"
-	"fmt"
+	"context"
+	"os"
 	"os/exec"
-	"strings"
+	"syscall"
+	"time"
 )
 
+const (
+	// KILL_GRACE is how long a timed out command may take to exit after
+	// SIGTERM before it is killed.
+	KILL_GRACE = 10 * time.Second
+)
+
+// Cmd runs local commands in Dir, or the current directory when Dir is
+// empty, and keeps the first error.
 type Cmd struct {
+	Dir string
+	// Env is added to the environment of the commands, and not logged.
+	Env []string
+	ctx context.Context
 	err error
 }
 
+func (c *Cmd) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
 func (c *Cmd) Err() error {
 	return c.err
 }
@@ -24,7 +43,10 @@ func (c *Cmd) Exec(name string, args ... string) {
 	if c.err != nil {
 		return
 	}
-	c.err = CmdExec(name, args...)
+	if c.err = checkInterrupted(interrupted); c.err != nil {
+		return
+	}
+	_, c.err = cmdOutput(c.context(), localhost, c.Dir, c.Env, name, args...)
 }
 
 func (c *Cmd) Output(name string, args ... string) string {
@@ -32,77 +54,78 @@ func (c *Cmd) Output(name string, args ... string) string {
 	if c.err != nil {
 		return ""
 	}
-	out, c.err = CmdOutput(name, args...)
+	if c.err = checkInterrupted(interrupted); c.err != nil {
+		return ""
+	}
+	out, c.err = cmdOutput(c.context(), localhost, c.Dir, c.Env, name, args...)
 
 	return out
 }
 
-func CmdExec(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	LogCmd(localhost, strings.Join(cmd.Args, " "))
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		err = errors.New(Chomp(stderr.String()))
-		return err
+// withCommandTimeout bounds a single command by command_timeout.
+func withCommandTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if commandTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-
-	out := Chomp(stdout.String())
-	if len(out) > 0 {
-		LogOut(localhost, out)
-	}
-
-	return err
+	return context.WithTimeout(ctx, commandTimeout)
 }
 
-func CmdOutput(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-	LogCmd(localhost, strings.Join(cmd.Args, " "))
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	b, err := cmd.Output()
-	if err != nil {
-		err = errors.New(Chomp(stderr.String()))
-		return "", err
-	}
-
-	ret := Chomp(string(b[:]))
-	if len(ret) > 0 {
-		LogOut(localhost, ret)
-	}
-	return ret, err
+func CmdExec(ctx context.Context, dir, name string, args ...string) error {
+	_, err := CmdOutput(ctx, dir, name, args...)
+	return err
 }
 
-func newCmd(name string, args ...string) *exec.Cmd {
-	return exec.Command(name, args...)
+// CmdOutput runs name in dir and returns its stdout. Nothing changes the
+// process working directory, so it is safe to call from any goroutine.
+func CmdOutput(ctx context.Context, dir, name string, args ...string) (string, error) {
+	return cmdOutput(ctx, localhost, dir, nil, name, args...)
 }
 
-func CmdPipe(c1, c2 *exec.Cmd) error {
-	c2.Stdin, _ = c1.StdoutPipe()
-
-	var out bytes.Buffer
-	c2.Stdout = &out
-
-	fmt.Printf("$ %s | %s \n", strings.Join(c1.Args, " "), strings.Join(c2.Args, " "))
-	err := c2.Start()
-	if err != nil {
-		return err
+// cmdOutput is CmdOutput logging the command as run for host, with env
+// added to its environment.
+func cmdOutput(ctx context.Context, host, dir string, env []string, name string, args ...string) (string, error) {
+	ctx, cancel := withCommandTimeout(ctx)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	// in a process group of its own, see localGroups
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
 	}
-
-	err = c1.Run()
-	if err != nil {
-		return err
+	cmd.WaitDelay = KILL_GRACE
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 
-	err = c2.Wait()
+	line := Sh(name, args...).String()
+	if dir != "" {
+		line = Cd(dir).And(name, args...).String()
+	}
+	LogCmd(host, line)
+
+	hb := startHeartbeat(host, line)
+	defer hb.Stop()
+	stdout := newLineWriter(host, hb)
+	stderr := newLineWriter(host, hb)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Start()
+	if err == nil {
+		untrack := trackLocalGroup(cmd.Process.Pid)
+		err = cmd.Wait()
+		untrack()
+	}
+	stdout.Flush()
+	stderr.Flush()
 	if err != nil {
-		return err
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", newCmdError(host, line, err, stdout.String(), stderr.String())
 	}
 
-	if out.Len() > 0 {
-		fmt.Printf("%s\n", out.String())
-	}
-	return nil
+	return Chomp(stdout.String()), nil
 }
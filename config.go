@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/BurntSushi/toml"
 )
@@ -16,7 +20,7 @@ var (
 )
 
 type ConfigApp struct {
-	Name string
+	Name string `toml:"name"`
 	GitRepoURL string `toml:"git_repo_url"`
 	GitBranch string `toml:"git_branch"`
 	GItSubmodules bool `toml:"git_submodules"`
@@ -25,13 +29,20 @@ type ConfigApp struct {
 	SharedFiles []string `toml:"shared_files"`
 	StageDir string `toml:"stage_dir"`
 	StageDefault string `toml:"stage_default"`
+	SecretsKeyFile string `toml:"secrets_key_file"`
+	// HistoryFile is only read from deploy.toml, so that one history
+	// covers every stage.
+	HistoryFile string `toml:"history_file"`
 }
 
 type ConfigServer struct {
 	SSHUser string `toml:"ssh_user"`
 	SSHPort int `toml:"ssh_port"`
-	SSHPass string `toml:"ssh_pass"`
+	SSHPass string `toml:"ssh_pass" secret:"true"`
 	SSHForwardAgent bool `toml:"ssh_forward_agent"`
+	SSHTimeout string `toml:"ssh_timeout"`
+	SSHKnownHosts string `toml:"ssh_known_hosts"`
+	SSHIgnoreHostKey bool `toml:"ssh_ignore_host_key"`
 	WebUser string `toml:"web_user"`
 	PHPBin string `toml:"php_bin"`
 }
@@ -43,75 +54,284 @@ type ConfigDeploy struct {
 	DeployKeepReleases int `toml:"deploy_keep_releases"`
 	DeployCachedCopy string `toml:"deploy_cached_copy"`
 	DeoloyExclude []string `toml:"deploy_exclude"`
+	DeployMinFreeSpace int `toml:"deploy_min_free_space"`
+	DeployTimeout string `toml:"deploy_timeout"`
+	CommandTimeout string `toml:"command_timeout"`
 }
 
 type server struct {
-	Host string
-	Port int
-	User string
-	Pass string
-	Roles []string
+	Host string `toml:"host"`
+	Port int `toml:"port"`
+	User string `toml:"user"`
+	Pass string `toml:"pass" secret:"true"`
+	Roles []string `toml:"roles"`
+	Transport string `toml:"transport"`
 	WebUser string `toml:"web_user"`
 	PHPBin string `toml:"php_bin"`
+	// Sources maps a key to the config entry its value came from.
+	Sources map[string]string `toml:"-"`
 }
 
 type Config struct {
 	LogLevel int `toml:"log_level"`
-	Env []string
+	Env []string `toml:"env"`
 	*ConfigApp
 	*ConfigServer
 	*ConfigDeploy
-	Servers []server
+	Servers []server `toml:"servers"`
 }
 
-func newConfig(stage string) *Config {
-	var baseConf Config
-	bytes, err := ioutil.ReadFile(PATH_CONFIG)
-	if err != nil {
-		LogError(localhost,err)
-		return nil
+// emptyConfig allocates the embedded sections, which toml leaves nil when a
+// file sets none of their keys.
+func emptyConfig() Config {
+	return Config{
+		ConfigApp: &ConfigApp{},
+		ConfigServer: &ConfigServer{},
+		ConfigDeploy: &ConfigDeploy{},
 	}
+}
 
-	if _, err := toml.Decode(string(bytes), &baseConf); err != nil {
-		LogError(localhost,err)
-		return nil
-	}
+// configLayer is one config file as decoded, before merging.
+type configLayer struct {
+	Path  string
+	Table map[string]interface{}
+}
 
-	stagePath := filepath.Join(baseConf.StageDir, stage + ".toml")
+func newConfig(stage string) (*Config, error) {
+	base, err := loadLayer(PATH_CONFIG)
+	if err != nil {
+		return nil, err
+	}
 
-	var conf Config
-	bytesStage, err := ioutil.ReadFile(stagePath)
+	stageDir, _ := base["stage_dir"].(string)
+	stageLayers, err := loadStage(stageDir, stage, nil)
 	if err != nil {
-		LogError(localhost,err)
-		return nil
+		return nil, err
 	}
+	lookup, err := stageVars(stageLayers)
+	if err != nil {
+		return nil, err
+	}
+	// the secrets layers are left out, a $ in a secret is part of its value
+	tables := []map[string]interface{}{base}
+	for _, l := range stageLayers {
+		tables = append(tables, l.Table)
+	}
+	if err := interpolateTables(tables, lookup); err != nil {
+		return nil, err
+	}
+	keyPath := secretsKeyPath(base)
 
-	mergedBytes := append(bytes, bytesStage...)
-	if _, err := toml.Decode(string(mergedBytes), &conf); err != nil {
-		LogError(localhost,err)
-		return nil
+	layers := []configLayer{{PATH_CONFIG, base}}
+	key := func() (*[32]byte, error) {
+		return loadSecretsKey(keyPath, false)
+	}
+	for _, l := range stageLayers {
+		layers = append(layers, l)
+		secrets, err := loadSecrets(strings.TrimSuffix(l.Path, ".toml")+".secrets", key)
+		if err != nil {
+			return nil, err
+		}
+		if secrets != nil {
+			layers = append(layers, *secrets)
+		}
+	}
+
+	merged := map[string]interface{}{}
+	for _, l := range layers {
+		merged = mergeTables(merged, l.Table)
 	}
 
+	conf := emptyConfig()
+	md, err := decodeTable(merged, &conf)
+	if err != nil {
+		return nil, mergedError(err, layers)
+	}
+	if problems := validateConfig(&conf, md, layers); len(problems) > 0 {
+		return nil, &ConfigError{Stage: stage, Problems: problems}
+	}
 
 	servers := make([]server, 0)
-	for _, v := range conf.Servers {
+	for i, v := range conf.Servers {
 		maxHostLength = MaxInt(maxHostLength, len(v.Host))
+		entry := fmt.Sprintf("servers[%d]", i)
+		v.Sources = map[string]string{}
+		setSource := func(key string, set bool, source string) {
+			if set {
+				v.Sources[key] = source
+			}
+		}
+
+		setSource("user", v.User != "", entry)
 		if v.User == "" {
 			v.User = conf.SSHUser
+			setSource("user", v.User != "", "ssh_user")
 		}
+		setSource("port", v.Port != 0, entry)
 		if v.Port == 0 {
 			v.Port = conf.SSHPort
+			setSource("port", v.Port != 0, "ssh_port")
+		}
+		setSource("pass", v.Pass != "", entry)
+		if v.Pass == "" {
+			v.Pass = conf.SSHPass
+			setSource("pass", v.Pass != "", "ssh_pass")
 		}
+		setSource("web_user", v.WebUser != "", entry)
 		if v.WebUser == "" {
 			v.WebUser = conf.WebUser
+			setSource("web_user", v.WebUser != "", "web_user")
 		}
+		setSource("php_bin", v.PHPBin != "", entry)
 		if v.PHPBin == "" {
 			v.PHPBin = conf.PHPBin
+			setSource("php_bin", v.PHPBin != "", "php_bin")
 		}
 		servers = append(servers, v)
 	}
 	conf.Servers = servers
+	registerConfigSecrets(&conf)
+
+	return &conf, nil
+}
 
-	return &conf
+
+// loadBase loads deploy.toml alone, for the keys read before a stage is,
+// with ${NAME} taken from the environment only: the .env files belong to
+// stages.
+func loadBase() (map[string]interface{}, error) {
+	base, err := loadLayer(PATH_CONFIG)
+	if err != nil {
+		return nil, err
+	}
+	lookup, err := stageVars(nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := interpolateTables([]map[string]interface{}{base}, lookup); err != nil {
+		return nil, err
+	}
+	return base, nil
 }
 
+// loadLayer loads the config file at path.
+func loadLayer(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLayer(path, b)
+}
+
+// decodeLayer decodes the config file at path with contents b into a table.
+// The values are checked against Config here, before merging, so that type
+// errors give the line in the file.
+func decodeLayer(path string, b []byte) (map[string]interface{}, error) {
+	table := map[string]interface{}{}
+	if _, err := toml.Decode(string(b), &table); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	conf := emptyConfig()
+	if _, err := toml.Decode(string(b), &conf); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return table, nil
+}
+
+// tomlKeyError matches a toml decode error, whose line is that of the
+// merged table and means nothing to the user.
+var tomlKeyError = regexp.MustCompile(`^toml: line \d+ \(last key "([^"]*)"\): (.*)$`)
+
+// mergedError names the file that sets the key err is about, for the errors
+// only the merged table has, such as appending values of another type.
+func mergedError(err error, layers []configLayer) error {
+	m := tomlKeyError.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	return fmt.Errorf("%s: %s: %s", keySource(toml.Key(strings.Split(m[1], ".")), layers), m[1], m[2])
+}
+
+// loadStage loads stage from dir, preceded by the stages it extends. seen
+// holds the stages already being loaded.
+func loadStage(dir, stage string, seen []string) ([]configLayer, error) {
+	for _, v := range seen {
+		if v == stage {
+			return nil, fmt.Errorf("stage %s extends itself: %s", stage, strings.Join(append(seen, stage), " -> "))
+		}
+	}
+	seen = append(seen, stage)
+
+	path := filepath.Join(dir, stage+".toml")
+	table, err := loadLayer(path)
+	if err != nil {
+		return nil, err
+	}
+	layer := configLayer{path, table}
+
+	parent, ok := table["extends"]
+	if !ok {
+		return []configLayer{layer}, nil
+	}
+	delete(table, "extends")
+	name, ok := parent.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s: extends must be a stage name", path)
+	}
+	layers, err := loadStage(dir, name, seen)
+	if err != nil {
+		return nil, err
+	}
+	return append(layers, layer), nil
+}
+
+// mergeTables merges src into dst and returns dst. Tables are merged key by
+// key, any other src value replaces the dst value, and a key ending in +
+// appends its array to the array of the key without the +.
+func mergeTables(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		if strings.HasSuffix(k, "+") {
+			k = strings.TrimSuffix(k, "+")
+			dst[k] = append(append([]interface{}{}, toArray(dst[k])...), toArray(v)...)
+			continue
+		}
+
+		srcTable, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		dstTable, ok := dst[k].(map[string]interface{})
+		if !ok {
+			dstTable = map[string]interface{}{}
+		}
+		dst[k] = mergeTables(dstTable, srcTable)
+	}
+	return dst
+}
+
+func toArray(v interface{}) []interface{} {
+	switch a := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return a
+	case []map[string]interface{}:
+		ret := make([]interface{}, 0, len(a))
+		for _, t := range a {
+			ret = append(ret, t)
+		}
+		return ret
+	default:
+		return []interface{}{a}
+	}
+}
+
+// decodeTable decodes a merged table into v by way of its TOML encoding.
+func decodeTable(table map[string]interface{}, v interface{}) (toml.MetaData, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(table); err != nil {
+		return toml.MetaData{}, err
+	}
+	return toml.Decode(buf.String(), v)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testBaseConfig = `git_repo_url = "/srv/git/app.git"
+git_branch = "master"
+stage_dir = "config/stages"
+deploy_to = "/srv/app"
+deploy_cached_copy = "tmp/cached-copy"
+deploy_keep_releases = 3
+shared_dirs = ["app/logs"]
+ssh_user = "deploy"
+
+[[servers]]
+host = "base1"
+`
+
+// inConfigDir writes files under a temp dir and makes it the working dir
+// for the rest of the test.
+func inConfigDir(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		writeFile(t, filepath.Join(dir, name), data)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestNewConfigMerge(t *testing.T) {
+	inConfigDir(t, map[string]string{
+		PATH_CONFIG: testBaseConfig,
+		"config/stages/staging.toml": `deploy_to = "/srv/staging"
+"shared_dirs+" = ["web/uploads"]
+
+[["servers+"]]
+host = "staging1"
+port = 2222
+`,
+		"config/stages/prod.toml": `extends = "staging"
+git_branch = "release"
+deploy_keep_releases = 5
+`,
+	})
+
+	conf, err := newConfig("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.GitBranch != "release" || conf.DeployTo != "/srv/staging" || conf.DeployKeepReleases != 5 {
+		t.Errorf("git_branch = %q, deploy_to = %q, deploy_keep_releases = %d", conf.GitBranch, conf.DeployTo, conf.DeployKeepReleases)
+	}
+	if conf.GitRepoURL != "/srv/git/app.git" {
+		t.Errorf("git_repo_url = %q, want it from deploy.toml", conf.GitRepoURL)
+	}
+	if want := []string{"app/logs", "web/uploads"}; !reflect.DeepEqual(conf.SharedDirs, want) {
+		t.Errorf("shared_dirs = %q, want %q", conf.SharedDirs, want)
+	}
+	hosts := []string{}
+	for _, s := range conf.Servers {
+		hosts = append(hosts, s.Host)
+	}
+	if want := []string{"base1", "staging1"}; !reflect.DeepEqual(hosts, want) {
+		t.Errorf("servers = %q, want %q", hosts, want)
+	}
+	if s := conf.Servers[1]; s.Port != 2222 || s.User != "deploy" {
+		t.Errorf("staging1 port = %d, user = %q", s.Port, s.User)
+	}
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		stage string
+		want  string
+	}{
+		{
+			name:  "type error in a stage file",
+			stage: "deploy_keep_releases = \"5\"\n",
+			want:  "config/stages/prod.toml: toml: line 1 (last key \"deploy_keep_releases\"): incompatible types",
+		},
+		{
+			name:  "type error in a server",
+			stage: "git_branch = \"release\"\n\n[[servers]]\nhost = \"web1\"\nport = \"22\"\n",
+			want:  "config/stages/prod.toml: toml: line 5 (last key \"servers.port\"): incompatible types",
+		},
+		{
+			name:  "appended value of another type",
+			stage: "\"shared_dirs+\" = [1]\n",
+			want:  "config/stages/prod.toml: shared_dirs: incompatible types",
+		},
+		{
+			name:  "duplicate key",
+			stage: "deploy_to = \"/a\"\ndeploy_to = \"/b\"\n",
+			want:  "config/stages/prod.toml: toml: line 2",
+		},
+		{
+			name:  "extends itself",
+			stage: "extends = \"prod\"\n",
+			want:  "stage prod extends itself: prod -> prod",
+		},
+		{
+			name:  "history_file in a stage",
+			stage: "history_file = \"log/prod.jsonl\"\n",
+			want:  "config/stages/prod.toml: history_file can only be set in " + PATH_CONFIG,
+		},
+		{
+			name:  "unknown key",
+			stage: "deploy_too = \"/a\"\n",
+			want:  "config/stages/prod.toml: unknown key deploy_too",
+		},
+	} {
+		inConfigDir(t, map[string]string{
+			PATH_CONFIG:               testBaseConfig,
+			"config/stages/prod.toml": tt.stage,
+		})
+		_, err := newConfig("prod")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNewConfigBaseTypeError(t *testing.T) {
+	inConfigDir(t, map[string]string{
+		PATH_CONFIG:               testBaseConfig + "\n[[servers]]\nhost = 1\n",
+		"config/stages/prod.toml": "",
+	})
+	_, err := newConfig("prod")
+	if want := PATH_CONFIG + ": toml: line 14 (last key \"servers.host\")"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error %v, want %q", err, want)
+	}
+}
+
+func TestNewConfigRequired(t *testing.T) {
+	inConfigDir(t, map[string]string{
+		PATH_CONFIG:               "stage_dir = \"config/stages\"\ndeploy_keep_releases = 1\n\n[[servers]]\nhost = \"web1\"\n",
+		"config/stages/prod.toml": "",
+	})
+	_, err := newConfig("prod")
+	if err == nil {
+		t.Fatal("loaded a config without the required keys")
+	}
+	for _, key := range []string{"git_repo_url", "deploy_to", "deploy_cached_copy"} {
+		if want := key + " is required"; !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v, want %q", err, want)
+		}
+	}
+}
+
+func TestNewConfigSecretsLiteral(t *testing.T) {
+	inConfigDir(t, map[string]string{
+		PATH_CONFIG:               testBaseConfig,
+		"config/stages/prod.toml": "\"env+\" = [\"HOME_DIR=${HOME}\", \"PRICE=$$5\"]\n",
+	})
+	var key [32]byte
+	copy(key[:], "0123456789abcdef0123456789abcdef")
+	t.Setenv(ENV_SECRETS_KEY, base64.StdEncoding.EncodeToString(key[:]))
+	t.Setenv("HOME", "/home/deploy")
+	data, err := encryptSecrets(&key, []byte(`"env+" = ["APP_DSN=mysql://u:pa$$w0rd@db", "APP_TOKEN=ab${CD}x"]`+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, "config/stages/prod.secrets", string(data))
+
+	conf, err := newConfig("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"HOME_DIR=/home/deploy", "PRICE=$5", "APP_DSN=mysql://u:pa$$w0rd@db", "APP_TOKEN=ab${CD}x"}
+	if !reflect.DeepEqual(conf.Env, want) {
+		t.Errorf("env = %q, want %q", conf.Env, want)
+	}
+	for _, v := range []string{"mysql://u:pa$$w0rd@db", "ab${CD}x"} {
+		if got := Redact("value " + v); got != "value "+REDACTED {
+			t.Errorf("Redact(%q) = %q", v, got)
+		}
+	}
+}
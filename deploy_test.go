@@ -0,0 +1,375 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProject is an app checkout whose stage test deploys the master branch
+// of a local bare repo to a testSSHServer.
+type testProject struct {
+	Dir      string
+	Origin   string
+	Work     string
+	DeployTo string
+	// Home is the home dir of cap, without an ssh config.
+	Home string
+	srv  *testSSHServer
+}
+
+func newTestProject(t *testing.T) *testProject {
+	t.Helper()
+	srv := startSSHServer(t)
+	// composer is installed and run by php, which fails in a release with
+	// a fail-composer file
+	srv.addCommand(t, "curl", "exit 0")
+	srv.addCommand(t, "php", `if [ -e fail-composer ]; then echo "composer failed" >&2; exit 1; fi`)
+	installRsync(t)
+
+	root := t.TempDir()
+	p := &testProject{
+		Dir:      filepath.Join(root, "app"),
+		Origin:   filepath.Join(root, "origin.git"),
+		Work:     filepath.Join(root, "work"),
+		DeployTo: filepath.Join(srv.Dir, "www"),
+		Home:     filepath.Join(root, "home"),
+		srv:      srv,
+	}
+	os.Mkdir(p.Home, 0755)
+	runGit(t, root, "init", "-q", "--bare", p.Origin)
+	runGit(t, root, "init", "-q", p.Work)
+	runGit(t, p.Work, "symbolic-ref", "HEAD", "refs/heads/master")
+
+	os.MkdirAll(filepath.Join(p.Dir, "config", "stages"), 0755)
+	writeFile(t, filepath.Join(p.Dir, PATH_CONFIG), `
+git_repo_url = `+strconv.Quote(p.Origin)+`
+git_branch = "master"
+stage_dir = "config/stages"
+deploy_to = `+strconv.Quote(p.DeployTo)+`
+deploy_cached_copy = "tmp/cached-copy"
+deploy_keep_releases = 2
+shared_dirs = ["app/logs"]
+shared_files = ["app/config/parameters.yml"]
+ssh_known_hosts = `+strconv.Quote(srv.KnownHosts)+`
+`)
+	writeFile(t, filepath.Join(p.Dir, "config", "stages", "test.toml"), srv.stanza())
+	return p
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %s\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// push commits files to master of the origin and returns the revision.
+func (p *testProject) push(t *testing.T, files map[string]string) string {
+	t.Helper()
+	for name, data := range files {
+		writeFile(t, filepath.Join(p.Work, name), data)
+	}
+	runGit(t, p.Work, "add", "-A")
+	runGit(t, p.Work, "commit", "-q", "-m", "update")
+	runGit(t, p.Work, "push", "-q", p.Origin, "master")
+	return runGit(t, p.Work, "rev-parse", "HEAD")
+}
+
+// cap runs cap with args on the stage test in the project dir, and
+// returns its exit code. The test binary runs as cap, see TestMain.
+func (p *testProject) cap(t *testing.T, args ...string) int {
+	t.Helper()
+	code, _ := p.capOutput(t, args...)
+	return code
+}
+
+// capOutput runs cap as cap does, and also returns its output.
+func (p *testProject) capOutput(t *testing.T, args ...string) (int, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], append([]string{"--quiet", "--stage", "test"}, args...)...)
+	cmd.Dir = p.Dir
+	cmd.Env = append(os.Environ(), ENV_TEST_MAIN+"=1", "HOME="+p.Home)
+	out, err := cmd.CombinedOutput()
+
+	code := EXIT_OK
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if code != EXIT_OK {
+		t.Logf("cap %s exited with %d:\n%s", strings.Join(args, " "), code, out)
+	}
+	return code, string(out)
+}
+
+func (p *testProject) path(elem ...string) string {
+	return filepath.Join(append([]string{p.DeployTo}, elem...)...)
+}
+
+func (p *testProject) releases(t *testing.T) []string {
+	t.Helper()
+	infos, err := ioutil.ReadDir(p.path("releases"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *testProject) current(t *testing.T) string {
+	t.Helper()
+	link, err := os.Readlink(p.path("current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link
+}
+
+func (p *testProject) revisionsLog(t *testing.T) []*revisionEntry {
+	t.Helper()
+	entries := []*revisionEntry{}
+	for _, line := range strings.Split(readFile(t, p.path(REVISIONS_LOG)), "\n") {
+		if e, ok := parseRevisionLine(line); ok {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// nextSecond waits until release names, which have a resolution of a
+// second, differ from the ones made so far.
+func nextSecond() {
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+}
+
+func TestSetup(t *testing.T) {
+	p := newTestProject(t)
+
+	if code := p.cap(t, "setup"); code != EXIT_OK {
+		t.Fatalf("setup exited with %d", code)
+	}
+	for _, dir := range []string{"", "releases", "shared"} {
+		if fi, err := os.Stat(p.path(dir)); err != nil || !fi.IsDir() {
+			t.Errorf("setup did not create %s", p.path(dir))
+		}
+	}
+
+	// a second setup changes nothing
+	if code := p.cap(t, "setup"); code != EXIT_OK {
+		t.Fatalf("second setup exited with %d", code)
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	p := newTestProject(t)
+	rev := p.push(t, map[string]string{
+		"index.php":                      "v1",
+		"app/logs/dev.log":               "from the repo",
+		"app/config/parameters.yml.dist": "dist",
+		"web/bundles/app.css":            "css",
+	})
+	if code := p.cap(t, "setup"); code != EXIT_OK {
+		t.Fatalf("setup exited with %d", code)
+	}
+
+	// releases left by earlier deploys, the oldest of which is pruned
+	for i, name := range []string{"20000101000000", "20000102000000"} {
+		os.MkdirAll(p.path("releases", name), 0755)
+		old := time.Now().Add(time.Duration(i-2) * time.Hour)
+		os.Chtimes(p.path("releases", name), old, old)
+	}
+	writeFile(t, p.path("shared", "app", "config", "parameters.yml"), "secret: kept")
+
+	if code := p.cap(t, "deploy"); code != EXIT_OK {
+		t.Fatalf("deploy exited with %d", code)
+	}
+
+	releases := p.releases(t)
+	if len(releases) != 2 || releases[0] != "20000102000000" {
+		t.Fatalf("releases = %v, want 20000102000000 and the new release", releases)
+	}
+	release := p.path("releases", releases[1])
+	if cur := p.current(t); cur != release {
+		t.Errorf("current = %s, want %s", cur, release)
+	}
+	if got := readFile(t, filepath.Join(release, "REVISION")); strings.TrimSpace(got) != rev {
+		t.Errorf("REVISION = %q, want %s", got, rev)
+	}
+	if got := readFile(t, p.path("current", "index.php")); got != "v1" {
+		t.Errorf("index.php = %q", got)
+	}
+	if got := readFile(t, p.path("current", "web", "bundles", "app.css")); got != "css" {
+		t.Errorf("web/bundles/app.css = %q", got)
+	}
+
+	for _, v := range []string{"app/logs", "app/config/parameters.yml"} {
+		link, err := os.Readlink(filepath.Join(release, v))
+		if err != nil || link != p.path("shared", v) {
+			t.Errorf("%s links to %q, %v, want %s", v, link, err, p.path("shared", v))
+		}
+	}
+	if IsExist(p.path("shared", "app", "logs", "dev.log")) {
+		t.Errorf("app/logs of the repo was copied into the shared dir")
+	}
+	if got := readFile(t, p.path("current", "app", "config", "parameters.yml")); got != "secret: kept" {
+		t.Errorf("shared parameters.yml = %q", got)
+	}
+
+	entries := p.revisionsLog(t)
+	if len(entries) != 1 || entries[0].Event != REVISION_DEPLOYED || entries[0].Fields["revision"] != rev {
+		t.Errorf("revisions.log = %+v", entries)
+	}
+	records, err := readHistory(filepath.Join(p.Dir, DEFAULT_HISTORY_FILE))
+	if err != nil || len(records) != 1 || records[0].Status != STATUS_OK || records[0].Revision != rev {
+		t.Errorf("history = %+v, %v", records, err)
+	}
+	if !IsExist(p.path("shared", DIR_REMOTE_TRACE, releases[1]+".log")) {
+		t.Errorf("the deploy log was not uploaded")
+	}
+
+	// the next deploy ships the new revision and prunes down to two
+	nextSecond()
+	rev = p.push(t, map[string]string{"index.php": "v2"})
+	if code := p.cap(t, "deploy"); code != EXIT_OK {
+		t.Fatalf("second deploy exited with %d", code)
+	}
+	if got := p.releases(t); len(got) != 2 || got[0] != releases[1] {
+		t.Errorf("releases = %v, want %s and the new release", got, releases[1])
+	}
+	if got := readFile(t, p.path("current", "index.php")); got != "v2" {
+		t.Errorf("index.php = %q after the second deploy", got)
+	}
+	if got := readFile(t, p.path("current", "REVISION")); strings.TrimSpace(got) != rev {
+		t.Errorf("REVISION = %q, want %s", got, rev)
+	}
+}
+
+func TestDeployRollback(t *testing.T) {
+	p := newTestProject(t)
+	p.push(t, map[string]string{"index.php": "v1"})
+	if code := p.cap(t, "setup"); code != EXIT_OK {
+		t.Fatalf("setup exited with %d", code)
+	}
+	if code := p.cap(t, "deploy"); code != EXIT_OK {
+		t.Fatalf("deploy exited with %d", code)
+	}
+	good := p.current(t)
+
+	nextSecond()
+	rev := p.push(t, map[string]string{"index.php": "v2", "fail-composer": ""})
+	if code := p.cap(t, "deploy"); code != EXIT_ROLLED_BACK {
+		t.Fatalf("failed deploy exited with %d, want %d", code, EXIT_ROLLED_BACK)
+	}
+
+	if cur := p.current(t); cur != good {
+		t.Errorf("current = %s, want it left at %s", cur, good)
+	}
+	if got := p.releases(t); len(got) != 1 || p.path("releases", got[0]) != good {
+		t.Errorf("releases = %v, want the failed release removed", got)
+	}
+	if got := readFile(t, p.path("current", "index.php")); got != "v1" {
+		t.Errorf("index.php = %q", got)
+	}
+
+	entries := p.revisionsLog(t)
+	last := entries[len(entries)-1]
+	if len(entries) != 2 || last.Event != REVISION_ROLLED_BACK || last.Fields["revision"] != rev {
+		t.Errorf("revisions.log = %+v", entries)
+	}
+	records, err := readHistory(filepath.Join(p.Dir, DEFAULT_HISTORY_FILE))
+	if err != nil || len(records) != 2 || records[1].ExitCode != EXIT_ROLLED_BACK {
+		t.Errorf("history = %+v, %v", records, err)
+	}
+}
+
+func TestDeployUploadFails(t *testing.T) {
+	p := newTestProject(t)
+	p.push(t, map[string]string{"index.php": "v1"})
+	if code := p.cap(t, "setup"); code != EXIT_OK {
+		t.Fatalf("setup exited with %d", code)
+	}
+	// the stand-in rsync extracts with tar on the server
+	p.srv.addCommand(t, "tar", `echo "tar: broken" >&2; exit 2`)
+
+	// nothing was created, so there is nothing to roll back
+	if code := p.cap(t, "deploy"); code != EXIT_FAILED {
+		t.Fatalf("deploy exited with %d, want %d", code, EXIT_FAILED)
+	}
+	if got := p.releases(t); len(got) != 0 {
+		t.Errorf("releases = %v", got)
+	}
+	if IsExist(p.path(REVISIONS_LOG)) {
+		t.Errorf("revisions.log = %q, want no entry", readFile(t, p.path(REVISIONS_LOG)))
+	}
+	records, err := readHistory(filepath.Join(p.Dir, DEFAULT_HISTORY_FILE))
+	if err != nil || len(records) != 1 || records[0].Status != STATUS_FAILED || records[0].ExitCode != EXIT_FAILED {
+		t.Errorf("history = %+v, %v", records, err)
+	}
+}
+
+func TestDeployUnreachable(t *testing.T) {
+	p := newTestProject(t)
+	p.push(t, map[string]string{"index.php": "v1"})
+	if code := p.cap(t, "setup"); code != EXIT_OK {
+		t.Fatalf("setup exited with %d", code)
+	}
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	stage := filepath.Join(p.Dir, "config", "stages", "test.toml")
+	writeFile(t, stage, readFile(t, stage)+"[[servers]]\nhost = \"localhost\"\nport = "+strconv.Itoa(port)+"\npass = \"secret\"\n")
+
+	code, out := p.capOutput(t, "deploy")
+	if code != EXIT_CONNECT {
+		t.Fatalf("deploy exited with %d, want %d", code, EXIT_CONNECT)
+	}
+	// the deploy log is not uploaded where there is no connection
+	if strings.Contains(out, "upload deploy log") {
+		t.Errorf("output = %s", out)
+	}
+	if got := p.current(t); got == "" {
+		t.Error("the reachable server was not deployed")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ERROR_TAIL_LINES is how many trailing lines of stdout and stderr a
+	// CmdError keeps.
+	ERROR_TAIL_LINES = 20
+)
+
+// CmdError describes a command that ran on Host and did not succeed.
+// ExitStatus is -1 when the command did not exit normally.
+type CmdError struct {
+	Host       string
+	Cmd        string
+	ExitStatus int
+	Signal     string
+	Stdout     string
+	Stderr     string
+	Err        error
+}
+
+func (e *CmdError) Error() string {
+	var reason string
+	switch {
+	case errors.Is(e.Err, context.DeadlineExceeded):
+		reason = "timed out"
+	case errors.Is(e.Err, context.Canceled):
+		reason = "canceled"
+	case e.Signal != "":
+		reason = "killed by signal " + e.Signal
+	case e.ExitStatus >= 0:
+		reason = fmt.Sprintf("exit status %d", e.ExitStatus)
+	default:
+		reason = e.Err.Error()
+	}
+
+	msg := firstLine(e.Stderr)
+	if msg == "" {
+		msg = firstLine(e.Stdout)
+	}
+	if msg == "" {
+		return fmt.Sprintf("%s: %s", e.Cmd, reason)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Cmd, reason, msg)
+}
+
+func (e *CmdError) Unwrap() error {
+	return e.Err
+}
+
+// newCmdError wraps the error returned by running cmd on host, keeping the
+// tails of the command's output with secrets masked.
+func newCmdError(host, cmd string, err error, stdout, stderr string) *CmdError {
+	e := &CmdError{
+		Host:       host,
+		Cmd:        Redact(cmd),
+		ExitStatus: -1,
+		Stdout:     Redact(tail(Chomp(stdout), ERROR_TAIL_LINES)),
+		Stderr:     Redact(tail(Chomp(stderr), ERROR_TAIL_LINES)),
+		Err:        err,
+	}
+
+	var sshErr *ssh.ExitError
+	var execErr *exec.ExitError
+	switch {
+	case errors.As(err, &sshErr):
+		e.ExitStatus = sshErr.ExitStatus()
+		e.Signal = sshErr.Signal()
+		if e.Signal != "" {
+			e.ExitStatus = -1
+		}
+	case errors.As(err, &execErr):
+		e.ExitStatus = execErr.ExitCode()
+		if ws, ok := execErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			e.Signal = ws.Signal().String()
+		}
+	}
+	return e
+}
+
+// IsExitStatus reports whether err is a CmdError for a command that exited
+// with one of codes, e.g. 1 for grep finding nothing.
+func IsExitStatus(err error, codes ...int) bool {
+	var e *CmdError
+	if !errors.As(err, &e) {
+		return false
+	}
+	for _, c := range codes {
+		if e.ExitStatus == c {
+			return true
+		}
+	}
+	return false
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func tail(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) <= n {
+		return s
+	}
+	return strings.Join(lines[len(lines)-n:], "\n")
+}
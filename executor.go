@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+)
+
+// Executor runs the commands of deploy steps on one host. Like Cmd it keeps
+// the first error, and every call after a failure does nothing.
+type Executor interface {
+	// Run runs c and discards its output.
+	Run(c *Command)
+	// Output runs c and returns its stdout.
+	Output(c *Command) string
+	// Exists reports whether path exists on the host.
+	Exists(path string) bool
+	// Upload mirrors the local directory src into dst on the host.
+	Upload(src, dst string)
+	// WriteFile writes data to the file path on the host.
+	WriteFile(path string, data []byte)
+	// Host is the name the host is logged as.
+	Host() string
+	// User is the user commands run as.
+	User() string
+	Err() error
+	SetErr(err error)
+	// Reset clears the error and detaches from the deploy deadline and
+	// interrupts, so that cleanup commands can still run.
+	Reset()
+	Close() error
+}
+
+const (
+	TRANSPORT_SSH = "ssh"
+	TRANSPORT_LOCAL = "local"
+)
+
+// newExecutor returns the Executor for server s according to its transport.
+func newExecutor(ctx context.Context, s server) Executor {
+	switch s.Transport {
+	case "", TRANSPORT_SSH:
+		return newConnection(ctx, s)
+	case TRANSPORT_LOCAL:
+		l := newLocalExecutor(ctx)
+		l.Name = s.Host
+		return l
+	default:
+		l := newLocalExecutor(ctx)
+		l.Name = s.Host
+		l.err = fmt.Errorf("unknown transport %q for %s", s.Transport, s.Host)
+		return l
+	}
+}
+
+// exists runs test -e on e, where exit status 1 means path is missing.
+func exists(e Executor, path string) bool {
+	if e.Err() != nil {
+		return false
+	}
+	e.Run(Sh("test", "-e", path))
+	if IsExitStatus(e.Err(), 1) {
+		e.SetErr(nil)
+		return false
+	}
+	return e.Err() == nil
+}
+
+// LocalExecutor is the Executor for the machine cap runs on. Commands run
+// through sh so that pipes and redirects behave as they do over ssh, and
+// Upload is a plain local copy.
+type LocalExecutor struct {
+	Name string
+	Dir  string
+	err  error
+	ctx  context.Context
+	stop <-chan struct{}
+}
+
+func newLocalExecutor(ctx context.Context) *LocalExecutor {
+	return &LocalExecutor{ctx: ctx, stop: interrupted}
+}
+
+func (l *LocalExecutor) Run(c *Command) {
+	l.Output(c)
+}
+
+func (l *LocalExecutor) Output(c *Command) string {
+	if l.err != nil {
+		return ""
+	}
+	if l.err = c.Err(); l.err != nil {
+		return ""
+	}
+	if l.err = checkInterrupted(l.stop); l.err != nil {
+		return ""
+	}
+	var out string
+	out, l.err = cmdOutput(l.ctx, l.Name, l.Dir, nil, "sh", "-c", c.String())
+	return out
+}
+
+func (l *LocalExecutor) Exists(path string) bool {
+	return exists(l, path)
+}
+
+func (l *LocalExecutor) Upload(src, dst string) {
+	l.Run(Sh("rm", "-rf", dst).And("mkdir", "-p", dst).And("cp", "-RPp", src+"/.", dst))
+}
+
+func (l *LocalExecutor) WriteFile(path string, data []byte) {
+	if l.err != nil {
+		return
+	}
+	LogCmd(l.Host(), "write "+path)
+	l.err = ioutil.WriteFile(path, data, 0644)
+}
+
+func (l *LocalExecutor) Host() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return localhost
+}
+
+func (l *LocalExecutor) User() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+func (l *LocalExecutor) Err() error {
+	return l.err
+}
+
+func (l *LocalExecutor) SetErr(err error) {
+	l.err = err
+}
+
+func (l *LocalExecutor) Reset() {
+	l.err = nil
+	l.ctx = context.Background()
+	l.stop = nil
+}
+
+func (l *LocalExecutor) Close() error {
+	return nil
+}
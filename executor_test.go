@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// RecordingExecutor records the commands it is given instead of running
+// them. Outputs and Errors answer commands by their command line.
+type RecordingExecutor struct {
+	Name     string
+	UserName string
+	Commands []string
+	Outputs  map[string]string
+	Errors   map[string]error
+	err      error
+}
+
+func (r *RecordingExecutor) Run(c *Command) {
+	r.Output(c)
+}
+
+func (r *RecordingExecutor) Output(c *Command) string {
+	if r.err != nil {
+		return ""
+	}
+	if r.err = c.Err(); r.err != nil {
+		return ""
+	}
+	line := c.String()
+	r.Commands = append(r.Commands, line)
+	if err, ok := r.Errors[line]; ok {
+		r.err = err
+		return ""
+	}
+	return r.Outputs[line]
+}
+
+func (r *RecordingExecutor) Exists(path string) bool {
+	return exists(r, path)
+}
+
+func (r *RecordingExecutor) Upload(src, dst string) {
+	if r.err != nil {
+		return
+	}
+	r.Commands = append(r.Commands, "upload "+src+" "+dst)
+}
+
+func (r *RecordingExecutor) WriteFile(path string, data []byte) {
+	if r.err != nil {
+		return
+	}
+	r.Commands = append(r.Commands, "write "+path)
+}
+
+func (r *RecordingExecutor) Host() string {
+	return r.Name
+}
+
+func (r *RecordingExecutor) User() string {
+	return r.UserName
+}
+
+func (r *RecordingExecutor) Err() error {
+	return r.err
+}
+
+func (r *RecordingExecutor) SetErr(err error) {
+	r.err = err
+}
+
+func (r *RecordingExecutor) Reset() {
+	r.err = nil
+}
+
+func (r *RecordingExecutor) Close() error {
+	return nil
+}
+
+// exitStatus is the error of a command that exited with code.
+func exitStatus(code int) error {
+	return &CmdError{Cmd: "test", ExitStatus: code}
+}
+
+func TestExists(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		errors map[string]error
+		want   bool
+		err    bool
+	}{
+		{"exists", nil, true, false},
+		{"missing", map[string]error{"test -e '/srv/my app'": exitStatus(1)}, false, false},
+		{"failed", map[string]error{"test -e '/srv/my app'": exitStatus(255)}, false, true},
+	} {
+		r := &RecordingExecutor{Errors: tt.errors}
+		if got := r.Exists("/srv/my app"); got != tt.want {
+			t.Errorf("%s: Exists = %v, want %v", tt.name, got, tt.want)
+		}
+		if (r.Err() != nil) != tt.err {
+			t.Errorf("%s: Err = %v", tt.name, r.Err())
+		}
+	}
+}
+
+func TestRecordingExecutorStopsAtError(t *testing.T) {
+	r := &RecordingExecutor{Errors: map[string]error{"false": exitStatus(1)}}
+	r.Run(Sh("true"))
+	r.Run(Sh("false"))
+	r.Run(Sh("echo", "skipped"))
+	r.Upload("/tmp/src", "/srv/dst")
+	want := []string{"true", "false"}
+	if !reflect.DeepEqual(r.Commands, want) {
+		t.Errorf("Commands = %q, want %q", r.Commands, want)
+	}
+}
+
+func TestLocalExecutor(t *testing.T) {
+	dir := t.TempDir()
+	l := newLocalExecutor(context.Background())
+	l.Dir = dir
+
+	l.Run(Sh("echo", "it's $HOME").To("out file"))
+	if got := l.Output(Sh("cat", "out file")); got != "it's $HOME" {
+		t.Errorf("Output = %q", got)
+	}
+	if !l.Exists(dir+"/out file") || l.Exists(dir+"/missing") {
+		t.Errorf("Exists is wrong")
+	}
+	if l.Err() != nil {
+		t.Fatal(l.Err())
+	}
+
+	l.Run(Sh("sh", "-c", "exit 3"))
+	if !IsExitStatus(l.Err(), 3) {
+		t.Errorf("Err = %v, want exit status 3", l.Err())
+	}
+}
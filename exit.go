@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/codegangsta/cli"
+)
+
+// Exit codes, so that CI can tell failures apart. EXIT_INTERRUPTED is used
+// when a second signal forces cap to quit.
+const (
+	EXIT_OK = iota
+	EXIT_ERROR
+	EXIT_CONFIG
+	EXIT_CONNECT
+	EXIT_BUILD
+	EXIT_PARTIAL
+	EXIT_FAILED
+	EXIT_ROLLED_BACK
+
+	EXIT_INTERRUPTED = 130
+)
+
+const EXIT_CODES_HELP = `
+EXIT CODES:
+   0    success
+   1    error, e.g. bad usage
+   2    invalid config
+   3    could not connect to or authenticate with the failed servers
+   4    local build failed, no server was touched, or this machine
+        failed cap check
+   5    partial failure, some servers failed
+   6    failure, all servers failed
+   7    all servers failed and were rolled back
+   130  interrupted twice and quit without cleanup
+`
+
+// osExit ends the process, replaced in tests.
+var osExit = os.Exit
+
+// the help is appended once, however many apps are made
+func init() {
+	cli.AppHelpTemplate += EXIT_CODES_HELP
+}
+
+// ExitError ends cap with Code. Err is logged when set; it is nil when the
+// failure has been logged already, as by a deploy summary.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+func exitError(code int, err error) error {
+	return &ExitError{Code: code, Err: err}
+}
+
+// run adapts an action returning an error to cli, exiting with the code
+// of the error.
+func run(action func(c *cli.Context) error) func(c *cli.Context) {
+	return func(c *cli.Context) {
+		err := action(c)
+		if err == nil {
+			return
+		}
+
+		code := EXIT_ERROR
+		var e *ExitError
+		if errors.As(err, &e) {
+			code, err = e.Code, e.Err
+		}
+		if err != nil {
+			LogError(localhost, err)
+		}
+		osExit(code)
+	}
+}
+
+// hostsExitCode is the exit code for a run on total servers of which failed
+// did not succeed, unreachable of them because they could not be connected
+// to, and rolledBack of them were rolled back.
+func hostsExitCode(total, failed, unreachable, rolledBack int) int {
+	switch {
+	case failed == 0:
+		return EXIT_OK
+	case unreachable == failed:
+		return EXIT_CONNECT
+	case failed < total:
+		return EXIT_PARTIAL
+	case rolledBack == failed:
+		return EXIT_ROLLED_BACK
+	default:
+		return EXIT_FAILED
+	}
+}
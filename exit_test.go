@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/cli"
+)
+
+func TestRun(t *testing.T) {
+	logLevel = LOG_CRIT
+	defer func() { osExit = os.Exit }()
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"success", nil, -1},
+		{"error", errors.New("bad usage"), EXIT_ERROR},
+		{"exit error", exitError(EXIT_PARTIAL, nil), EXIT_PARTIAL},
+		{"wrapped exit error", fmt.Errorf("deploy: %w", exitError(EXIT_CONFIG, errors.New("no deploy_to"))), EXIT_CONFIG},
+	} {
+		code := -1
+		osExit = func(c int) { code = c }
+		run(func(*cli.Context) error { return tt.err })(nil)
+		if code != tt.code {
+			t.Errorf("%s: exit code %d, want %d", tt.name, code, tt.code)
+		}
+	}
+}
+
+func TestHostsExitCode(t *testing.T) {
+	for _, tt := range []struct {
+		total, failed, unreachable, rolledBack int
+		want                                   int
+	}{
+		{3, 0, 0, 0, EXIT_OK},
+		{3, 2, 2, 0, EXIT_CONNECT},
+		{3, 1, 0, 1, EXIT_PARTIAL},
+		{3, 3, 1, 0, EXIT_FAILED},
+		{3, 3, 0, 3, EXIT_ROLLED_BACK},
+		{3, 3, 0, 2, EXIT_FAILED},
+	} {
+		if got := hostsExitCode(tt.total, tt.failed, tt.unreachable, tt.rolledBack); got != tt.want {
+			t.Errorf("hostsExitCode(%d, %d, %d, %d) = %d, want %d", tt.total, tt.failed, tt.unreachable, tt.rolledBack, got, tt.want)
+		}
+	}
+}
+
+func TestExitCodesHelp(t *testing.T) {
+	newApp()
+	newApp()
+	if n := strings.Count(cli.AppHelpTemplate, "EXIT CODES:"); n != 1 {
+		t.Errorf("the help lists the exit codes %d times", n)
+	}
+}
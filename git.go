@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -17,15 +19,10 @@ func init() {
 	enableSubmodule = false
 }
 
-func GitRevision(branch string) (string, error) {
-	prev, err := filepath.Abs(".")
-	if err != nil {
-		return "", err
-	}
-	defer os.Chdir(prev)
-	os.Chdir(cachedCopy)
-
+func GitRevision(ctx context.Context, repo, branch string) (string, error) {
 	out, err := CmdOutput(
+		ctx,
+		repo,
 		"git",
 		"rev-list",
 		"--max-count=1",
@@ -39,50 +36,42 @@ func GitRevision(branch string) (string, error) {
 	return Chomp(out), nil
 }
 
-func archive(branch string) error {
-	tempDir, _:= TempDir()
-	defer os.RemoveAll(tempDir)
-
-	cmd1 := newCmd(
-		"git",
-		"archive",
-		branch,
-	)
-	cmd2 := newCmd(
-		"tar",
-		"-x",
-		"--strip-components",
-		"0",
-		"-f",
-		"-",
-		"-C",
-		tempDir,
-	)
-	err := CmdPipe(cmd1, cmd2)
+// checkCachedCopy refuses a repo dir that is empty or holds the current
+// directory, where git reset --hard and git clean would wipe the project
+// cap runs in.
+func checkCachedCopy(repo string) error {
+	if repo == "" {
+		return errors.New("deploy_cached_copy is not set")
+	}
+	abs, err := filepath.Abs(repo)
 	if err != nil {
-		fmt.Printf("err = %+v\n", err)
 		return err
 	}
-
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if wd == abs || strings.HasPrefix(wd, abs+string(filepath.Separator)) || abs == string(filepath.Separator) {
+		return fmt.Errorf("deploy_cached_copy %s contains the current directory, refusing to run git there", repo)
+	}
 	return nil
 }
 
-func GitCheckout(branch string) (string, error) {
-	lenText := LogInfo(localhost, "Git checkout repository ")
+func GitCheckout(ctx context.Context, url, repo, branch string) (string, error) {
+	step := LogInfo(localhost, "Git checkout repository ")
 
-	var rev, prev string
-	cli := &Cmd{}
+	var rev string
+	cli := &Cmd{ctx: ctx}
+	cli.err = checkCachedCopy(repo)
 
-	if !IsExist(cachedCopy) {
-		cli.Exec("git","clone","-b", config.GitBranch, config.GitRepoURL, config.DeployCachedCopy)
+	if cli.err == nil && !IsExist(repo) {
+		cli.Exec("git","clone","-b", branch, url, repo)
 	}
 
-	prev, cli.err = filepath.Abs(".")
-
-	defer os.Chdir(prev)
-	os.Chdir(cachedCopy)
-
-	rev, cli.err = GitRevision(branch)
+	cli.Dir = repo
+	if cli.err == nil {
+		rev, cli.err = GitRevision(ctx, repo, branch)
+	}
 
 	if cli.Output("git", "branch", "--list", "deploy")  == "" {
 		cli.Exec("git", "checkout", "-b", "deploy", rev)
@@ -95,29 +84,28 @@ func GitCheckout(branch string) (string, error) {
 	}
 
 	if cli.err != nil {
-		LogNG(lenText)
+		LogNG(step)
 		LogError(localhost, cli.err)
 		return "", cli.err
 	}
-	LogOK(lenText)
+	LogOK(step)
 
 	return rev, nil
 }
 
-func GitSync(branch string) (string, error) {
-	lenText := LogInfo(localhost, "Git fetch repository ")
+func GitSync(ctx context.Context, repo, branch string) (string, error) {
+	step := LogInfo(localhost, "Git fetch repository ")
 
-	var rev, prev string
-	cli := &Cmd{}
-	prev, cli.err = filepath.Abs(".")
-
-	defer os.Chdir(prev)
-	os.Chdir(cachedCopy)
+	var rev string
+	cli := &Cmd{ctx: ctx, Dir: repo}
+	cli.err = checkCachedCopy(repo)
 
 	cli.Exec("git","fetch","origin",)
 	cli.Exec("git","fetch","--tags", "origin",)
 
-	rev, cli.err = GitRevision(branch)
+	if cli.err == nil {
+		rev, cli.err = GitRevision(ctx, repo, branch)
+	}
 	cli.Exec("git","reset","--hard",rev)
 
 	if enableSubmodule {
@@ -128,11 +116,11 @@ func GitSync(branch string) (string, error) {
 
 	cli.Exec("git","clean","-d","-x","-f",)
 	if cli.err != nil {
-		LogNG(lenText)
+		LogNG(step)
 		LogError(localhost, cli.err)
 		return "", cli.err
 	}
-	LogOK(lenText)
+	LogOK(step)
 
 	return rev, nil
 }
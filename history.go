@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+const (
+	// DEFAULT_HISTORY_FILE is where deploys are recorded unless
+	// history_file is set.
+	DEFAULT_HISTORY_FILE = "log/history.jsonl"
+)
+
+// HistoryRecord is one deploy in the history file, a JSON object per line.
+type HistoryRecord struct {
+	ID       int    `json:"id"`
+	User     string `json:"user"`
+	From     string `json:"from"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	*Report
+}
+
+// historyPath is history_file of deploy.toml, read alone so that the
+// history of any stage can be listed.
+func historyPath() (string, error) {
+	base, err := loadBase()
+	if os.IsNotExist(err) {
+		return DEFAULT_HISTORY_FILE, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if v, ok := base["history_file"].(string); ok && v != "" {
+		return expandHome(v), nil
+	}
+	return DEFAULT_HISTORY_FILE, nil
+}
+
+func deployUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// status names the outcome of r, like its exit code.
+func (r *Report) status() string {
+	switch r.exitCode() {
+	case EXIT_OK:
+		return STATUS_OK
+	case EXIT_BUILD:
+		return "build failed"
+	case EXIT_CONNECT:
+		return "unreachable"
+	case EXIT_PARTIAL:
+		return "partial"
+	case EXIT_ROLLED_BACK:
+		return STATUS_ROLLED_BACK
+	default:
+		return STATUS_FAILED
+	}
+}
+
+func readHistory(path string) ([]*HistoryRecord, error) {
+	records := []*HistoryRecord{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		rec := &HistoryRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %s", path, n, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// recordHistory appends the deploy r to the history file. The file is
+// locked from reading the last id to writing the next one, so that
+// concurrent deploys do not take the same id.
+func recordHistory(path string, r *Report) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("lock %s: %s", path, err)
+	}
+
+	records, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	id := 1
+	if len(records) > 0 {
+		id = records[len(records)-1].ID + 1
+	}
+	b, err := json.Marshal(&HistoryRecord{
+		ID:       id,
+		User:     deployUser(),
+		From:     localhost,
+		Status:   r.status(),
+		ExitCode: r.exitCode(),
+		Report:   r,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// capHistory lists the deploys of every stage, or of the stage of -s.
+func capHistory(c *cli.Context) error {
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	records, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	stage := ""
+	if c.GlobalIsSet("stage") {
+		stage = c.GlobalString("stage")
+	}
+
+	rows := [][]string{}
+	for _, rec := range records {
+		if stage != "" && rec.Stage != stage {
+			continue
+		}
+		rev := rec.Revision
+		if len(rev) > 7 {
+			rev = rev[:7]
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(rec.ID),
+			rec.Started.Local().Format(time.RFC3339),
+			rec.Stage,
+			rev,
+			rec.Branch,
+			rec.Release,
+			rec.User,
+			strconv.Itoa(len(rec.servers())),
+			formatSeconds(rec.Duration),
+			rec.Status,
+		})
+	}
+	LogTable("deploy", []string{"ID", "DATE", "STAGE", "REVISION", "BRANCH", "RELEASE", "USER", "HOSTS", "TIME", "STATUS"}, rows)
+	return nil
+}
+
+func capHistoryShow(c *cli.Context) error {
+	id, err := strconv.Atoi(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("usage: cap history show <id>")
+	}
+	format, err := reportFormat("", c.String("format"))
+	if err != nil {
+		return err
+	}
+	path, err := historyPath()
+	if err != nil {
+		return err
+	}
+	records, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		if rec.ID != id {
+			continue
+		}
+		if logFormat == LOG_FORMAT_JSON {
+			logJSON(logEvent{Event: "deploy", Deploy: rec})
+			return nil
+		}
+		title := fmt.Sprintf("Deploy #%d by %s from %s: %s\n\n", rec.ID, rec.User, rec.From, rec.Status)
+		switch format {
+		case REPORT_JSON:
+			b, err := json.MarshalIndent(rec, "", "  ")
+			if err != nil {
+				return err
+			}
+			LogResult(string(b))
+		case REPORT_MARKDOWN:
+			LogResult(title + strings.TrimSuffix(rec.Markdown(), "\n"))
+		default:
+			LogResult(title + strings.TrimSuffix(rec.Text(), "\n"))
+		}
+		return nil
+	}
+	return fmt.Errorf("no deploy #%d in %s", id, path)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestRecordHistoryConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log", "history.jsonl")
+	r := &Report{Stage: "prod", Hosts: []*HostReport{{Host: localhost, Local: true, Status: STATUS_OK}}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := recordHistory(path, r); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	records, err := readHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, rec := range records {
+		ids = append(ids, rec.ID)
+	}
+	sort.Ints(ids)
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("ids %v, want 1 to 20 once each", ids)
+		}
+	}
+}
+
+func TestHistoryPath(t *testing.T) {
+	inConfigDir(t, map[string]string{
+		PATH_CONFIG: "history_file = \"${CAP_LOG_DIR}/history.jsonl\"\n" + testBaseConfig,
+	})
+	t.Setenv("CAP_LOG_DIR", "/var/log/cap")
+	if path, err := historyPath(); err != nil || path != "/var/log/cap/history.jsonl" {
+		t.Errorf("historyPath() = %q, %v", path, err)
+	}
+
+	os.Remove(PATH_CONFIG)
+	if path, err := historyPath(); err != nil || path != DEFAULT_HISTORY_FILE {
+		t.Errorf("historyPath() without deploy.toml = %q, %v", path, err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// matches $$, ${NAME} and ${NAME:-default}
+	interpolation = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+)
+
+// stageVars returns the variables config values may refer to: those of the
+// .env file next to each stage file, where a stage overrides the stages it
+// extends, and the process environment, which overrides them all.
+func stageVars(stageLayers []configLayer) (func(string) (string, bool), error) {
+	vars := map[string]string{}
+	for _, l := range stageLayers {
+		path := strings.TrimSuffix(l.Path, ".toml") + ".env"
+		dotEnv, err := loadDotEnv(path)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range dotEnv {
+			vars[k] = v
+		}
+	}
+
+	return func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		v, ok := vars[name]
+		return v, ok
+	}, nil
+}
+
+// loadDotEnv reads KEY=VALUE lines from path. A missing file is empty.
+func loadDotEnv(path string) (map[string]string, error) {
+	vars := map[string]string{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return vars, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || !envName.MatchString(strings.TrimSpace(kv[0])) {
+			return nil, fmt.Errorf("%s: line %d: expected KEY=VALUE", path, n)
+		}
+		vars[strings.TrimSpace(kv[0])] = unquote(strings.TrimSpace(kv[1]))
+	}
+	return vars, scanner.Err()
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// interpolateTables replaces ${NAME} and ${NAME:-default} in every string
+// of tables, and $$ with $. All undefined names are reported at once.
+func interpolateTables(tables []map[string]interface{}, lookup func(string) (string, bool)) error {
+	missing := map[string]bool{}
+	for _, table := range tables {
+		for k, v := range table {
+			table[k] = interpolateValue(v, lookup, missing)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(missing))
+	for k := range missing {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("config refers to undefined variables: %s", strings.Join(names, ", "))
+}
+
+func interpolateValue(v interface{}, lookup func(string) (string, bool), missing map[string]bool) interface{} {
+	switch t := v.(type) {
+	case string:
+		return interpolateString(t, lookup, missing)
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = interpolateValue(child, lookup, missing)
+		}
+		return t
+	case []map[string]interface{}:
+		for _, child := range t {
+			interpolateValue(child, lookup, missing)
+		}
+		return t
+	case []interface{}:
+		for i, child := range t {
+			t[i] = interpolateValue(child, lookup, missing)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func interpolateString(s string, lookup func(string) (string, bool), missing map[string]bool) string {
+	return interpolation.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		sub := interpolation.FindStringSubmatch(m)
+		name, hasDefault, def := sub[1], sub[2] != "", sub[3]
+		v, ok := lookup(name)
+		if hasDefault && (!ok || v == "") {
+			return def
+		}
+		if !ok {
+			missing[name] = true
+		}
+		return v
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var (
+	errInterrupted = errors.New("interrupted")
+
+	// interrupted is closed on the first SIGINT or SIGTERM. Commands that
+	// have not started yet fail with errInterrupted from then on.
+	interrupted = make(chan struct{})
+	interruptOnce sync.Once
+
+	forceExitMu sync.Mutex
+	forceExitFuncs []func()
+
+	// localGroups are the process groups of the running local commands.
+	// They are not in the group of cap, so that a Ctrl-C in the terminal
+	// lets them finish, and are only signalled when cap is forced to quit.
+	localGroupsMu sync.Mutex
+	localGroups = map[int]bool{}
+)
+
+// handleInterrupt catches SIGINT and SIGTERM until the returned func is
+// called. The first signal closes interrupted and lets running commands
+// finish, a second one runs the atForceExit funcs and exits immediately.
+func handleInterrupt() func() {
+	ch := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-ch:
+			LogError(localhost, fmt.Errorf("received %s, waiting for running commands and rolling back (repeat to force quit)", sig))
+			interruptOnce.Do(func() { close(interrupted) })
+		case <-done:
+			return
+		}
+
+		select {
+		case sig := <-ch:
+			LogError(localhost, fmt.Errorf("received %s again, exiting", sig))
+			if s, ok := sig.(syscall.Signal); ok {
+				signalLocalGroups(s)
+			}
+			forceExit(EXIT_INTERRUPTED)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// checkInterrupted returns errInterrupted once a signal has been received.
+func checkInterrupted(stop <-chan struct{}) error {
+	select {
+	case <-stop:
+		return errInterrupted
+	default:
+		return nil
+	}
+}
+
+// trackLocalGroup records the process group pgid of a local command until
+// the returned func is called.
+func trackLocalGroup(pgid int) func() {
+	localGroupsMu.Lock()
+	localGroups[pgid] = true
+	localGroupsMu.Unlock()
+	return func() {
+		localGroupsMu.Lock()
+		delete(localGroups, pgid)
+		localGroupsMu.Unlock()
+	}
+}
+
+// signalLocalGroups sends sig to every running local command and its
+// children.
+func signalLocalGroups(sig syscall.Signal) {
+	localGroupsMu.Lock()
+	defer localGroupsMu.Unlock()
+	for pgid := range localGroups {
+		syscall.Kill(-pgid, sig)
+	}
+}
+
+// atForceExit registers f to run when a second signal forces cap to exit
+// without unwinding, e.g. to remove temp dirs.
+func atForceExit(f func()) {
+	forceExitMu.Lock()
+	forceExitFuncs = append(forceExitFuncs, f)
+	forceExitMu.Unlock()
+}
+
+func forceExit(code int) {
+	forceExitMu.Lock()
+	for _, f := range forceExitFuncs {
+		f()
+	}
+	forceExitMu.Unlock()
+	os.Exit(code)
+}
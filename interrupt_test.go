@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLocalCommandProcessGroup(t *testing.T) {
+	logLevel = LOG_CRIT
+	out, err := CmdOutput(context.Background(), "", "sh", "-c", `cut -d " " -f 5 /proc/$$/stat`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pgid, _ := strconv.Atoi(out); pgid == syscall.Getpgrp() {
+		t.Errorf("the command runs in the process group of cap, %d", pgid)
+	}
+}
+
+func TestSignalLocalGroups(t *testing.T) {
+	logLevel = LOG_CRIT
+	done := make(chan error, 1)
+	go func() {
+		// the signal reaches the child of sh too
+		done <- CmdExec(context.Background(), "", "sh", "-c", "sleep 30; true")
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		localGroupsMu.Lock()
+		n := len(localGroups)
+		localGroupsMu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the command did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	signalLocalGroups(syscall.SIGTERM)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("the command was not signalled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command still runs after the signal")
+	}
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
+	"github.com/codegangsta/cli"
 	"github.com/fatih/color"
+	"github.com/mattn/go-isatty"
 )
 
 const (
@@ -14,70 +24,415 @@ const (
 	LOG_TRACE
 )
 
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+var (
+	logFormat = LOG_FORMAT_TEXT
+	logStage  string
+	// logLevelFlag is the level given on the command line, which wins
+	// over log_level
+	logLevelFlag int
+
+	// logMu serializes all output, which hosts write from their own
+	// goroutines
+	logMu sync.Mutex
+	// hostSteps is the step each host is running
+	hostSteps = map[string]*Step{}
+	// logBuffered holds a host's lines on a terminal until its step
+	// finishes, so that parallel hosts print whole sections. Elsewhere,
+	// lines are written as they come, each prefixed with its host.
+	logBuffered = isatty.IsTerminal(os.Stdout.Fd())
+)
+
+// Step is a named piece of work on a host, logged when it starts and when
+// it finishes.
+type Step struct {
+	Host    string
+	Name    string
+	Start   time.Time
+	lenText int
+	buf     bytes.Buffer
+}
+
+// logEvent is one line of --log-format=json output.
+type logEvent struct {
+	Time       time.Time `json:"time"`
+	Stage      string    `json:"stage,omitempty"`
+	Host       string    `json:"host,omitempty"`
+	Event      string    `json:"event"`
+	Step       string    `json:"step,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	Duration   float64   `json:"duration,omitempty"`
+	Status     string    `json:"status,omitempty"`
+	ExitStatus *int      `json:"exit_status,omitempty"`
+	Signal     string    `json:"signal,omitempty"`
+	Stdout     string    `json:"stdout,omitempty"`
+	Stderr     string    `json:"stderr,omitempty"`
+	Report     *Report   `json:"report,omitempty"`
+	// Fields is a row of a listing, see LogTable.
+	Fields map[string]string `json:"fields,omitempty"`
+	Deploy *HistoryRecord    `json:"deploy,omitempty"`
+}
+
+// setLogOptions applies the global logging flags. Colors are off when
+// NO_COLOR is set or stdout is not a terminal.
+func setLogOptions(c *cli.Context) error {
+	switch format := c.GlobalString("log-format"); format {
+	case LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+		logFormat = format
+	default:
+		return fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+
+	switch {
+	case c.GlobalBool("verbose") && c.GlobalBool("quiet"):
+		return errors.New("--verbose and --quiet cannot be used together")
+	case c.GlobalString("log-level") != "":
+		level, err := parseLogLevel(c.GlobalString("log-level"))
+		if err != nil {
+			return err
+		}
+		logLevelFlag = level
+	case c.GlobalBool("verbose"):
+		logLevelFlag = LOG_DEBUG
+	case c.GlobalBool("quiet"):
+		logLevelFlag = LOG_CRIT
+	}
+	logLevel = logLevelFlag
+
+	if c.GlobalBool("no-color") || os.Getenv("NO_COLOR") != "" || !isatty.IsTerminal(os.Stdout.Fd()) {
+		color.NoColor = true
+	}
+	return nil
+}
+
+func parseLogLevel(s string) (int, error) {
+	for i, name := range []string{"crit", "info", "debug", "trace"} {
+		if s == name || s == fmt.Sprint(i+LOG_CRIT) {
+			return i + LOG_CRIT, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, use crit, info, debug or trace", s)
+}
+
+// logQuiet reports whether only errors and the final summary are printed.
+func logQuiet() bool {
+	return logLevel == LOG_CRIT
+}
+
+func logJSON(e logEvent) {
+	e.Time = time.Now()
+	e.Stage = logStage
+	logMu.Lock()
+	defer logMu.Unlock()
+	if step, ok := hostSteps[e.Host]; ok && e.Step == "" {
+		e.Step = step.Name
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// logLine writes one line for host, held back while host is in a step
+// when output is buffered.
+func logLine(host, line string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if step, ok := hostSteps[host]; ok && logBuffered {
+		step.buf.WriteString(line + "\n")
+		return
+	}
+	fmt.Fprintln(color.Output, line)
+}
+
 func Log(text string) {
-	fmt.Println(text)
+	trace(localhost, "%s", text)
+	if logFormat == LOG_FORMAT_JSON {
+		if !logQuiet() {
+			logJSON(logEvent{Event: "info", Message: Redact(text)})
+		}
+		return
+	}
+	if !logQuiet() {
+		logLine("", Redact(text))
+	}
 }
 
 func formatHost (s string) string {
 	return fmt.Sprintf("[%%-%ds] ", maxHostLength) + s
 }
 
-func LogInfo(host, text string) int {
-	lenText := 0
-	if logLevel < LOG_DEBUG {
-		color.Set(color.FgGreen)
-		logText := fmt.Sprintf(
-			formatHost("# %s"),
-			host,
-			text,
-		)
-		lenText = len(logText)
-		fmt.Printf(logText)
-		color.Unset()
+// LogHost logs a message about host that is not a step.
+func LogHost(host, text string) {
+	trace(host, "# %s", strings.TrimSpace(text))
+	if logQuiet() {
+		return
 	}
-	if logLevel >= LOG_DEBUG {
-		fmt.Println("")
+	if logFormat == LOG_FORMAT_JSON {
+		logJSON(logEvent{Host: host, Event: "info", Message: Redact(strings.TrimSpace(text))})
+		return
 	}
-	return lenText
+	logLine(host, color.GreenString(formatHost("# %s"), host, Redact(strings.TrimSpace(text))))
+}
+
+// LogInfo starts the step text on host. Finish it with LogOK or LogNG,
+// which print the step line.
+func LogInfo(host, text string) *Step {
+	step := &Step{Host: host, Name: strings.TrimSpace(text), Start: time.Now()}
+	step.lenText = len(fmt.Sprintf(formatHost("# %s"), host, Redact(step.Name)))
+
+	logMu.Lock()
+	hostSteps[host] = step
+	logMu.Unlock()
+	trace(host, "# start: %s", step.Name)
+
+	if logFormat == LOG_FORMAT_JSON && !logQuiet() {
+		logJSON(logEvent{Host: host, Event: "step_start", Step: step.Name})
+	}
+	return step
 }
 
 func LogDebug(host, text string) {
+	trace(host, "%s", text)
 	if logLevel >= LOG_DEBUG {
-		color.Yellow(formatHost("%s\n"), host, text)
+		if logFormat == LOG_FORMAT_JSON {
+			logJSON(logEvent{Host: host, Event: "debug", Message: Redact(text)})
+			return
+		}
+		logLine(host, color.YellowString(formatHost("%s"), host, Redact(text)))
 	}
 }
 
 func LogCmd(host, text string) {
+	trace(host, "$ %s", text)
 	if logLevel >= LOG_DEBUG {
-		color.Yellow(formatHost("$ %s\n"), host, text)
+		if logFormat == LOG_FORMAT_JSON {
+			logJSON(logEvent{Host: host, Event: "command", Command: Redact(text)})
+			return
+		}
+		logLine(host, color.YellowString(formatHost("$ %s"), host, Redact(text)))
 	}
 }
 
 func LogOut(host, text string) {
+	trace(host, "| %s", text)
 	if logLevel >= LOG_TRACE {
-		color.White("[%s] %s\n", host, text)
+		if logFormat == LOG_FORMAT_JSON {
+			logJSON(logEvent{Host: host, Event: "output", Message: Redact(text)})
+			return
+		}
+		logLine(host, color.WhiteString("[%s] %s", host, Redact(text)))
 	}
 }
 
-func LogError(host string, err error) {
-	color.Red("[%s] %s\n", host, err)
+func LogWait(host, text string, elapsed time.Duration) {
+	trace(host, "… still running after %s: %s", elapsed.Round(time.Second), text)
+	if logQuiet() {
+		return
+	}
+	if logFormat == LOG_FORMAT_JSON {
+		logJSON(logEvent{Host: host, Event: "waiting", Command: Redact(text), Duration: elapsed.Seconds()})
+		return
+	}
+	// not held back, a buffered step would hide that it is still running
+	line := color.YellowString(formatHost("… still running after %s: %s"), host, elapsed.Round(time.Second), Redact(text))
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprintln(color.Output, line)
+}
+
+// LogWarn logs a problem that is not an error.
+func LogWarn(text string) {
+	trace(localhost, "warning: %s", text)
+	if logQuiet() {
+		return
+	}
+	if logFormat == LOG_FORMAT_JSON {
+		logJSON(logEvent{Event: "warning", Message: Redact(text)})
+		return
+	}
+	logLine("", color.YellowString("warning: %s", Redact(text)))
 }
 
-func logProgress (l int) {
-	fmt.Printf(" %s", strings.Repeat(".", 80 - l))
+// LogCheck logs the result of the check name on host, failed when err is
+// set. --quiet prints only the failed checks.
+func LogCheck(host, name string, err error) {
+	if err != nil {
+		trace(host, "✘ %s: %s", name, err)
+	} else {
+		trace(host, "✔ %s", name)
+		if logQuiet() {
+			return
+		}
+	}
+	if logFormat == LOG_FORMAT_JSON {
+		ev := logEvent{Host: host, Event: "check", Step: name, Status: "ok"}
+		if err != nil {
+			ev.Status = "failed"
+			ev.Message = Redact(err.Error())
+		}
+		logJSON(ev)
+		return
+	}
+	if err != nil {
+		logLine(host, color.RedString(formatHost("✘ %s: %s"), host, name, Redact(err.Error())))
+		return
+	}
+	logLine(host, color.GreenString(formatHost("✔ %s"), host, name))
 }
 
-func LogOK(l int) {
-	if logLevel < LOG_DEBUG {
-		logProgress(l)
-		color.Green("✔")
+// LogResult prints text, the result of a command such as cap
+// deploy:pending. Like the deploy summary, even --quiet prints it.
+func LogResult(text string) {
+	if logFormat == LOG_FORMAT_JSON {
+		logJSON(logEvent{Event: "result", Message: Redact(text)})
+		return
+	}
+	logLine("", Redact(text))
+}
+
+// LogTable prints the rows of a listing under header, even with --quiet.
+// With --log-format=json each row is an event, its fields named by the
+// lower case header.
+func LogTable(event string, header []string, rows [][]string) {
+	if logFormat == LOG_FORMAT_JSON {
+		for _, row := range rows {
+			fields := map[string]string{}
+			for i, v := range row {
+				fields[strings.ToLower(header[i])] = v
+			}
+			logJSON(logEvent{Event: event, Fields: fields})
+		}
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	w := tabwriter.NewWriter(color.Output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+func LogError(host string, err error) {
+	var e *CmdError
+	isCmd := errors.As(err, &e)
+	trace(host, "! %s", err)
+	if isCmd {
+		for _, v := range []struct{ name, out string }{{"stderr", e.Stderr}, {"stdout", e.Stdout}} {
+			if v.out != "" {
+				trace(host, "! %s:\n%s", v.name, v.out)
+			}
+		}
+	}
+
+	if logFormat == LOG_FORMAT_JSON {
+		ev := logEvent{Host: host, Event: "error", Message: Redact(err.Error())}
+		if isCmd {
+			ev.Command = e.Cmd
+			if e.ExitStatus >= 0 {
+				ev.ExitStatus = &e.ExitStatus
+			}
+			ev.Signal = e.Signal
+			ev.Stdout = e.Stdout
+			ev.Stderr = e.Stderr
+		}
+		logJSON(ev)
+		return
+	}
+
+	red := func(format string, a ...interface{}) {
+		logLine(host, color.RedString(format, a...))
+	}
+	if !isCmd {
+		red("[%s] %s", host, Redact(err.Error()))
+		return
+	}
+
+	red("[%s] command failed: %s", host, Redact(e.Cmd))
+	switch {
+	case errors.Is(e.Err, context.DeadlineExceeded), errors.Is(e.Err, context.Canceled):
+		red("[%s]   error: %s", host, e.Err)
+	case e.Signal != "":
+		red("[%s]   signal: %s", host, e.Signal)
+	case e.ExitStatus >= 0:
+		red("[%s]   exit status: %d", host, e.ExitStatus)
+	default:
+		red("[%s]   error: %s", host, e.Err)
+	}
+	for _, v := range []struct{ name, out string }{{"stderr", e.Stderr}, {"stdout", e.Stdout}} {
+		if v.out == "" {
+			continue
+		}
+		for _, line := range strings.Split(v.out, "\n") {
+			red("[%s]   %s| %s", host, v.name, Redact(line))
+		}
 	}
 }
 
-func LogNG(l int) {
-	if logLevel < LOG_DEBUG {
-		logProgress(l)
-		color.Red("✘")
+func logProgress (l int) string {
+	return " " + strings.Repeat(".", MaxInt(80 - l, 3))
+}
+
+// logFinish ends step, flushing the lines held back during it followed by
+// the step line.
+func logFinish(step *Step, ok bool) {
+	logMu.Lock()
+	if hostSteps[step.Host] == step {
+		delete(hostSteps, step.Host)
+	}
+	logMu.Unlock()
+	elapsed := time.Since(step.Start)
+	recordStep(step, ok, elapsed)
+	if ok {
+		trace(step.Host, "# ok: %s (%s)", step.Name, elapsed.Round(time.Millisecond))
+	} else {
+		trace(step.Host, "# failed: %s (%s)", step.Name, elapsed.Round(time.Millisecond))
 	}
+	if logQuiet() {
+		return
+	}
+
+	if logFormat == LOG_FORMAT_JSON {
+		status := "ok"
+		if !ok {
+			status = "failed"
+		}
+		logJSON(logEvent{
+			Host:     step.Host,
+			Event:    "step_finish",
+			Step:     step.Name,
+			Duration: elapsed.Seconds(),
+			Status:   status,
+		})
+		return
+	}
+
+	mark := color.GreenString("✔")
+	if !ok {
+		mark = color.RedString("✘")
+	}
+	line := color.GreenString(formatHost("# %s"), step.Host, Redact(step.Name)) +
+		logProgress(step.lenText) + mark
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	color.Output.Write(step.buf.Bytes())
+	fmt.Fprintln(color.Output, line)
+}
+
+func LogOK(step *Step) {
+	logFinish(step, true)
 }
 
+func LogNG(step *Step) {
+	logFinish(step, false)
+}
@@ -11,7 +11,13 @@ var (
 )
 
 func main() {
-	newApp().Run(os.Args)
+	if os.Getenv(ENV_RSH) != "" {
+		os.Exit(rsh(os.Args[1:]))
+	}
+	if err := newApp().Run(os.Args); err != nil {
+		LogError(localhost, err)
+		os.Exit(EXIT_ERROR)
+	}
 }
 
 func newApp() (app *cli.App) {
@@ -25,25 +31,142 @@ func newApp() (app *cli.App) {
 			Value: "prod",
 			Usage: "stage for deploy",
 		},
+		cli.StringFlag{
+			Name: "log-format",
+			Value: LOG_FORMAT_TEXT,
+			Usage: "log output format, text or json",
+		},
+		cli.StringFlag{
+			Name: "log-level",
+			Usage: "crit, info, debug or trace, overriding log_level",
+		},
+		cli.BoolFlag{
+			Name: "verbose",
+			Usage: "log commands too, same as --log-level=debug",
+		},
+		cli.BoolFlag{
+			Name: "quiet, q",
+			Usage: "print only errors and the result, such as the deploy summary or the failed checks",
+		},
+		cli.BoolFlag{
+			Name: "no-color",
+			Usage: "disable colors, as does NO_COLOR or output that is not a terminal",
+		},
 	}
+	app.Before = setLogOptions
 	app.Commands = []cli.Command{
 		{
 			Name:      "init",
 			Aliases:     []string{"i"},
 			Usage:     "create config files",
-			Action: capInit,
+			Action: run(capInit),
 		},
 		{
 			Name:      "deploy",
 			Aliases:     []string{"d"},
 			Usage:     "add a task to the list",
-			Action: capDeploy,
+			Action: run(capDeploy),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "report-file",
+					Usage: "also write the summary to this file",
+				},
+				cli.StringFlag{
+					Name: "report-format",
+					Usage: "text, markdown or json, by default from the extension of --report-file",
+				},
+			},
+		},
+		{
+			Name:    "deploy:pending",
+			Aliases: []string{"pending"},
+			Usage:   "show the commits and changed files a deploy would ship",
+			Action:  run(capDeployPending),
 		},
 		{
 			Name:      "setup",
 			Aliases:     []string{"s"},
 			Usage:     "complete a task on the list",
-			Action: capSetup,
+			Action: run(capSetup),
+		},
+		{
+			Name:      "check",
+			Aliases:     []string{"c"},
+			Usage:     "check servers are ready for deploy",
+			Action: run(capCheck),
+		},
+		{
+			Name:  "secrets",
+			Usage: "manage the encrypted secrets of a stage",
+			Subcommands: []cli.Command{
+				{
+					Name:   "edit",
+					Usage:  "decrypt the secrets into $EDITOR and encrypt them again",
+					Action: run(capSecretsEdit),
+				},
+				{
+					Name:   "encrypt",
+					Usage:  "encrypt a plaintext TOML file, or stdin, as the secrets",
+					Action: run(capSecretsEncrypt),
+				},
+				{
+					Name:   "decrypt",
+					Usage:  "print the decrypted secrets",
+					Action: run(capSecretsDecrypt),
+				},
+			},
+		},
+		{
+			Name:   "audit",
+			Usage:  "list the deploys and rollbacks recorded in revisions.log on the servers",
+			Action: run(capAudit),
+		},
+		{
+			Name:   "history",
+			Usage:  "list past deploys, of every stage unless --stage is given",
+			Action: run(capHistory),
+			Subcommands: []cli.Command{
+				{
+					Name:      "show",
+					Usage:     "print the report of a deploy",
+					ArgsUsage: "<id>",
+					Action:    run(capHistoryShow),
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "format, f",
+							Value: REPORT_TEXT,
+							Usage: "text, markdown or json",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:      "config",
+			Usage:     "inspect the config of a stage",
+			Subcommands: []cli.Command{
+				{
+					Name:   "validate",
+					Usage:  "check the config without connecting to servers",
+					Action: run(capConfigValidate),
+				},
+				{
+					Name:   "show",
+					Usage:  "print the effective config of the stage",
+					Action: run(capConfigShow),
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "format, f",
+							Value: "toml",
+							Usage: "toml or json",
+						},
+						cli.StringFlag{
+							Name:  "host",
+							Usage: "only show this server",
+						},
+					},
+				},
+			},
 		},
 	}
 	return
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// ENV_TEST_MAIN makes the test binary run main, so that tests can run it as
+// the cap command.
+const ENV_TEST_MAIN = "CAP_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	// the test binary is also the remote shell of the rsync of Upload
+	if os.Getenv(ENV_TEST_MAIN) != "" || os.Getenv(ENV_RSH) != "" {
+		main()
+		os.Exit(EXIT_OK)
+	}
+	os.Exit(m.Run())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/codegangsta/cli"
+)
+
+// deployedRevision reads the REVISION file of the current release on the
+// host of s. It is empty when nothing has been deployed yet.
+func deployedRevision(ctx context.Context, s server) (string, error) {
+	conn := newExecutor(ctx, s)
+	defer conn.Close()
+
+	path := filepath.Join(pathCurrent(), "REVISION")
+	if !conn.Exists(path) {
+		return "", conn.Err()
+	}
+	rev := strings.TrimSpace(conn.Output(Sh("cat", path)))
+	return rev, conn.Err()
+}
+
+// capDeployPending shows what a deploy of git_branch would ship: the commits
+// and changed files since the revision the servers run.
+func capDeployPending(c *cli.Context) error {
+	if err := setupStage(c); err != nil {
+		return err
+	}
+
+	ctx, cancel := deployContext()
+	defer cancel()
+
+	target, err := updateSrc(ctx, config.GitBranch)
+	if err != nil {
+		return exitError(EXIT_BUILD, nil)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	hostsByRev := map[string][]string{}
+	failed := 0
+	wg.Add(len(config.Servers))
+	for _, v := range config.Servers {
+		go func(s server) {
+			defer wg.Done()
+			rev, err := deployedRevision(ctx, s)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				LogError(s.Host, err)
+				failed++
+				return
+			}
+			hostsByRev[rev] = append(hostsByRev[rev], s.Host)
+		}(v)
+	}
+	wg.Wait()
+
+	revs := make([]string, 0, len(hostsByRev))
+	for rev, hosts := range hostsByRev {
+		sort.Strings(hosts)
+		revs = append(revs, rev)
+	}
+	sort.Strings(revs)
+
+	if len(revs) > 1 {
+		text := "servers run different revisions:"
+		for _, rev := range revs {
+			text += fmt.Sprintf("\n  %s  %s", shortRevision(rev), strings.Join(hostsByRev[rev], ", "))
+		}
+		LogWarn(text)
+	}
+
+	for _, rev := range revs {
+		LogResult(fmt.Sprintf("\n%s → %s (%s) on %s",
+			shortRevision(rev), shortRevision(target), config.GitBranch, strings.Join(hostsByRev[rev], ", ")))
+		if err := showPending(ctx, rev, target); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return exitError(hostsExitCode(len(config.Servers), failed, 0, 0),
+			fmt.Errorf("could not read the deployed revision on %d of %d servers", failed, len(config.Servers)))
+	}
+	return nil
+}
+
+// showPending prints the log and diffstat from the deployed revision rev to
+// target in the cached copy.
+func showPending(ctx context.Context, rev, target string) error {
+	cli := &Cmd{ctx: ctx, Dir: cachedCopy}
+	switch {
+	case rev == "":
+		LogWarn(fmt.Sprintf("nothing deployed yet, all of %s is pending", config.GitBranch))
+		LogResult(cli.Output("git", "log", "--oneline", "--no-decorate", target))
+		return cli.Err()
+	case rev == target:
+		LogResult("up to date, nothing pending")
+		return nil
+	}
+
+	if CmdExec(ctx, cachedCopy, "git", "cat-file", "-e", rev+"^{commit}") != nil {
+		LogWarn(fmt.Sprintf("%s is not in the repository, was the branch force-pushed?", shortRevision(rev)))
+		return nil
+	}
+	err := CmdExec(ctx, cachedCopy, "git", "merge-base", "--is-ancestor", rev, target)
+	switch {
+	case IsExitStatus(err, 1):
+		LogWarn(fmt.Sprintf("%s is not an ancestor of %s, deploying drops the commits only on the servers:\n%s",
+			shortRevision(rev), shortRevision(target), cli.Output("git", "log", "--oneline", "--no-decorate", target+".."+rev)))
+		LogResult("pending:")
+	case err != nil:
+		return err
+	}
+
+	LogResult(cli.Output("git", "log", "--oneline", "--no-decorate", rev+".."+target))
+	LogResult(cli.Output("git", "diff", "--stat", rev, target))
+	return cli.Err()
+}
+
+func shortRevision(rev string) string {
+	if rev == "" {
+		return "(none)"
+	}
+	if len(rev) > 7 {
+		return rev[:7]
+	}
+	return rev
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	REDACTED = "********"
+	// MIN_SECRET_LENGTH keeps very short values from masking unrelated
+	// text all over the logs.
+	MIN_SECRET_LENGTH = 4
+)
+
+var (
+	secretsMu    sync.RWMutex
+	secretValues []string
+	// secretEnvName matches env names like DB_PASSWORD or GITHUB_TOKEN.
+	secretEnvName = regexp.MustCompile(`(?i)(^|_)(PASS|PASSWD|PASSWORD|SECRET|TOKEN|KEY|CREDENTIALS?)$`)
+)
+
+// AddSecret registers v to be masked in all log output, both as is and in
+// the quoted form it takes in command lines.
+func AddSecret(v string) {
+	if len(v) < MIN_SECRET_LENGTH {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, s := range []string{v, ShellQuote(v)} {
+		if !StringInSlice(secretValues, s) {
+			secretValues = append(secretValues, s)
+		}
+	}
+	// longest first, so a secret containing another is masked whole
+	sort.Slice(secretValues, func(i, j int) bool {
+		return len(secretValues[i]) > len(secretValues[j])
+	})
+}
+
+// Redact masks every registered secret in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, v := range secretValues {
+		s = strings.Replace(s, v, REDACTED, -1)
+	}
+	return s
+}
+
+// registerConfigSecrets registers the values of conf that must not be
+// logged: fields tagged secret:"true" and env entries with a secret name.
+func registerConfigSecrets(conf *Config) {
+	registerSecretFields(reflect.ValueOf(conf))
+	for _, v := range conf.Env {
+		if kv := strings.SplitN(v, "=", 2); len(kv) == 2 && secretEnvName.MatchString(kv[0]) {
+			AddSecret(kv[1])
+		}
+	}
+}
+
+func registerSecretFields(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			registerSecretFields(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			registerSecretFields(v.Index(i))
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := v.Field(i)
+			if t.Field(i).Tag.Get("secret") == "true" && f.Kind() == reflect.String {
+				AddSecret(f.String())
+				continue
+			}
+			registerSecretFields(f)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const (
+	REPORT_TEXT     = "text"
+	REPORT_MARKDOWN = "markdown"
+	REPORT_JSON     = "json"
+
+	STATUS_OK          = "ok"
+	STATUS_FAILED      = "failed"
+	STATUS_ROLLED_BACK = "rolled back"
+	STATUS_SKIPPED     = "skipped"
+)
+
+// Report is the outcome of a deploy, host by host and step by step.
+type Report struct {
+	Stage    string        `json:"stage"`
+	Branch   string        `json:"branch"`
+	Revision string        `json:"revision"`
+	Release  string        `json:"release"`
+	Started  time.Time     `json:"started"`
+	Duration float64       `json:"duration"`
+	Hosts    []*HostReport `json:"hosts"`
+
+	// building is set until the local build is done. Steps logged for
+	// localhost after it are those of a server of that name.
+	building bool
+}
+
+type HostReport struct {
+	Host string `json:"host"`
+	// Local is set on the build on this machine, which comes first.
+	Local       bool          `json:"local,omitempty"`
+	Status      string        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+	Unreachable bool          `json:"unreachable,omitempty"`
+	Steps       []*StepReport `json:"steps"`
+}
+
+type StepReport struct {
+	Name     string  `json:"name"`
+	Duration float64 `json:"duration"`
+	Status   string  `json:"status"`
+}
+
+// The report of the running deploy, filled in as steps finish.
+var (
+	reportMu sync.Mutex
+	report   *Report
+)
+
+// startReport begins the report of a deploy of release to hosts.
+func startReport(stage, branch, release string, hosts []server) *Report {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	report = &Report{
+		Stage:    stage,
+		Branch:   branch,
+		Release:  release,
+		Started:  time.Now(),
+		Hosts:    []*HostReport{{Host: localhost, Local: true, Status: STATUS_OK}},
+		building: true,
+	}
+	// until finishHost, a host was not deployed to
+	for _, s := range hosts {
+		report.Hosts = append(report.Hosts, &HostReport{Host: s.Host, Status: STATUS_SKIPPED})
+	}
+	return report
+}
+
+// buildDone ends the local build, before the deploy to the servers.
+func (r *Report) buildDone() {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	r.building = false
+}
+
+// host is the row of server name, which is never the local build even when
+// the server is named after this machine.
+func (r *Report) host(name string) *HostReport {
+	for _, h := range r.Hosts {
+		if h.Host == name && !h.Local {
+			return h
+		}
+	}
+	h := &HostReport{Host: name, Status: STATUS_OK}
+	r.Hosts = append(r.Hosts, h)
+	return h
+}
+
+// recordStep adds a finished step to the running report, if any.
+func recordStep(step *Step, ok bool, elapsed time.Duration) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	if report == nil {
+		return
+	}
+	status := STATUS_OK
+	if !ok {
+		status = STATUS_FAILED
+	}
+	h := report.Hosts[0]
+	if !report.building || step.Host != localhost {
+		h = report.host(step.Host)
+	}
+	h.Steps = append(h.Steps, &StepReport{Name: step.Name, Duration: elapsed.Seconds(), Status: status})
+	if !ok {
+		h.Status = STATUS_FAILED
+	}
+}
+
+// finishHost records how the deploy ended on host. err is nil when it
+// succeeded.
+func (r *Report) finishHost(host string, err error, rolledBack bool) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	h := r.host(host)
+	switch {
+	case err == nil:
+		h.Status = STATUS_OK
+	case rolledBack:
+		h.Status = STATUS_ROLLED_BACK
+	default:
+		h.Status = STATUS_FAILED
+	}
+	if err != nil {
+		h.Error = Redact(firstLine(err.Error()))
+	}
+}
+
+// servers are the hosts of r but the local build.
+func (r *Report) servers() []*HostReport {
+	ret := []*HostReport{}
+	for _, h := range r.Hosts {
+		if !h.Local {
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+// hostUnreachable records that host could not be connected to.
+func (r *Report) hostUnreachable(host string) {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	r.host(host).Unreachable = true
+}
+
+// exitCode is the exit status of cap deploy for r.
+func (r *Report) exitCode() int {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	total, failed, unreachable, rolledBack := 0, 0, 0, 0
+	for _, h := range r.Hosts {
+		if h.Local {
+			if h.Status != STATUS_OK {
+				return EXIT_BUILD
+			}
+			continue
+		}
+		total++
+		if h.Status == STATUS_OK {
+			continue
+		}
+		failed++
+		if h.Unreachable {
+			unreachable++
+		}
+		if h.Status == STATUS_ROLLED_BACK {
+			rolledBack++
+		}
+	}
+	return hostsExitCode(total, failed, unreachable, rolledBack)
+}
+
+// finish stops the clock and detaches the report from the logger.
+func (r *Report) finish() {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	r.Duration = time.Since(r.Started).Seconds()
+	if report == r {
+		report = nil
+	}
+}
+
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Millisecond).String()
+}
+
+func (r *Report) title() string {
+	rev := r.Revision
+	if len(rev) > 7 {
+		rev = rev[:7]
+	}
+	return fmt.Sprintf("Deploy of %s (%s) to %s, release %s, in %s",
+		rev, r.Branch, r.Stage, r.Release, formatSeconds(r.Duration))
+}
+
+// rows are the lines of the summary table: the steps of each host, and
+// the host's result.
+func (r *Report) rows() [][]string {
+	rows := [][]string{}
+	for _, h := range r.Hosts {
+		total := 0.0
+		for _, s := range h.Steps {
+			rows = append(rows, []string{h.Host, s.Name, formatSeconds(s.Duration), s.Status})
+			total += s.Duration
+		}
+		result := h.Status
+		if h.Error != "" {
+			result += ": " + h.Error
+		}
+		rows = append(rows, []string{h.Host, "total", formatSeconds(total), result})
+	}
+	return rows
+}
+
+func (r *Report) Text() string {
+	var buf bytes.Buffer
+	buf.WriteString(r.title() + "\n\n")
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTEP\tTIME\tSTATUS")
+	for _, row := range r.rows() {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+	return buf.String()
+}
+
+func (r *Report) Markdown() string {
+	var buf bytes.Buffer
+	buf.WriteString("### " + r.title() + "\n\n")
+	buf.WriteString("| Host | Step | Time | Status |\n")
+	buf.WriteString("|------|------|-----:|--------|\n")
+	for _, row := range r.rows() {
+		for i, v := range row {
+			row[i] = strings.Replace(v, "|", "\\|", -1)
+		}
+		buf.WriteString("| " + strings.Join(row, " | ") + " |\n")
+	}
+	return buf.String()
+}
+
+func (r *Report) JSON() string {
+	b, _ := json.MarshalIndent(r, "", "  ")
+	return string(b) + "\n"
+}
+
+// reportFormat is format, or else the one the extension of path names.
+func reportFormat(path, format string) (string, error) {
+	if format == "" {
+		switch filepath.Ext(path) {
+		case ".md", ".markdown":
+			format = REPORT_MARKDOWN
+		case ".json":
+			format = REPORT_JSON
+		default:
+			format = REPORT_TEXT
+		}
+	}
+	switch format {
+	case REPORT_TEXT, REPORT_MARKDOWN, REPORT_JSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown report format %q, use text, markdown or json", format)
+	}
+}
+
+func writeReport(r *Report, path, format string) error {
+	var out string
+	switch format {
+	case REPORT_MARKDOWN:
+		out = r.Markdown()
+	case REPORT_JSON:
+		out = r.JSON()
+	default:
+		out = r.Text()
+	}
+	return ioutil.WriteFile(path, []byte(out), 0644)
+}
+
+// LogReport prints the summary of r. Even --quiet prints it.
+func LogReport(r *Report) {
+	trace(localhost, "%s", r.Text())
+	if logFormat == LOG_FORMAT_JSON {
+		logJSON(logEvent{Event: "summary", Report: r})
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprint(color.Output, "\n"+r.Text())
+}
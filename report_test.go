@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReportServerNamedLocalhost(t *testing.T) {
+	logLevel = LOG_CRIT
+	r := startReport("prod", "master", "20240102030405", []server{
+		{Host: localhost, Transport: TRANSPORT_LOCAL},
+		{Host: "web1"},
+	})
+	defer r.finish()
+
+	recordStep(&Step{Host: localhost, Name: "Update local src"}, true, time.Second)
+	r.buildDone()
+	recordStep(&Step{Host: localhost, Name: "Create latest release"}, false, time.Second)
+	r.finishHost(localhost, errors.New("cp failed"), false)
+	recordStep(&Step{Host: "web1", Name: "Create latest release"}, true, time.Second)
+	r.finishHost("web1", nil, false)
+
+	if len(r.Hosts) != 3 {
+		t.Fatalf("hosts = %d, want the build and 2 servers", len(r.Hosts))
+	}
+	build, server := r.Hosts[0], r.Hosts[1]
+	if !build.Local || build.Status != STATUS_OK || len(build.Steps) != 1 || build.Steps[0].Name != "Update local src" {
+		t.Errorf("build row = %+v", build)
+	}
+	if server.Local || server.Host != localhost || server.Status != STATUS_FAILED || len(server.Steps) != 1 {
+		t.Errorf("server row = %+v", server)
+	}
+	if code := r.exitCode(); code != EXIT_PARTIAL {
+		t.Errorf("exit code %d, want %d", code, EXIT_PARTIAL)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ENV_RSH holds the rshTarget of an Upload. When it is set, cap runs as the
+// remote shell of rsync instead of as the cap command.
+const ENV_RSH = "CAP_RSH"
+
+// rshTarget is how to connect to the host of an Upload, as newConnection
+// did. It goes in the environment rather than on the command line, which
+// other users can read.
+type rshTarget struct {
+	Host          SshConfigHost
+	Pass          string
+	KnownHosts    string
+	IgnoreHostKey bool
+	Timeout       time.Duration
+}
+
+// rsh runs the command rsync gives it, as in "rsh [-l user] host command...",
+// on the host of $CAP_RSH, with its stdin and stdout as those of the
+// command. The user and host of the arguments are those the rsync of Upload
+// was given, and are ignored. It returns the exit status of the command.
+func rsh(args []string) int {
+	var t rshTarget
+	if err := json.Unmarshal([]byte(os.Getenv(ENV_RSH)), &t); err != nil {
+		fmt.Fprintf(os.Stderr, "cap: %s: %s\n", ENV_RSH, err)
+		return 255
+	}
+	if len(args) > 1 && args[0] == "-l" {
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "cap: usage: [-l user] host command...")
+		return 255
+	}
+
+	cli, err := dialHost(context.Background(), &t.Host, t.Pass, t.KnownHosts, t.IgnoreHostKey, t.Timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cap: %s: %s\n", t.Host.Host, err)
+		return 255
+	}
+	defer cli.Close()
+	sess, err := cli.NewSession()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cap: %s: %s\n", t.Host.Host, err)
+		return 255
+	}
+	defer sess.Close()
+
+	sess.Stdin = os.Stdin
+	sess.Stdout = os.Stdout
+	sess.Stderr = os.Stderr
+	err = sess.Run(strings.Join(args[1:], " "))
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cap: %s: %s\n", t.Host.Host, err)
+		return 255
+	}
+	return 0
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/codegangsta/cli"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	SECRETS_HEADER = "cap-secrets:v1:"
+	// ENV_SECRETS_KEY holds the base64 key when no key file is used, e.g.
+	// in CI.
+	ENV_SECRETS_KEY = "CAP_SECRETS_KEY"
+)
+
+// secretsPath is the encrypted secrets file of stage, next to its config.
+func secretsPath(stageDir, stage string) string {
+	return filepath.Join(stageDir, stage+".secrets")
+}
+
+// secretsKeyPath is secrets_key_file of base, or else the key of the app
+// in $XDG_CONFIG_HOME/cap, out of the repository the secrets are in.
+func secretsKeyPath(base map[string]interface{}) string {
+	if v, ok := base["secrets_key_file"].(string); ok && v != "" {
+		return expandHome(v)
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "cap", appName(base)+".key")
+}
+
+// appName is the repository name of git_repo_url, as in
+// git@github.com:acme/shop.git, or else the name of the current directory.
+func appName(base map[string]interface{}) string {
+	url, _ := base["git_repo_url"].(string)
+	name := strings.TrimSuffix(path.Base(strings.Replace(url, ":", "/", -1)), ".git")
+	if url != "" && name != "" && name != "." && name != "/" {
+		return name
+	}
+	wd, _ := os.Getwd()
+	return filepath.Base(wd)
+}
+
+// loadSecretsKey reads the key from $CAP_SECRETS_KEY or path. With create
+// set, a missing key file is generated.
+func loadSecretsKey(path string, create bool) (*[32]byte, error) {
+	encoded := os.Getenv(ENV_SECRETS_KEY)
+	if encoded == "" {
+		b, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && create {
+			return generateSecretsKey(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("secrets key: %s", err)
+		}
+		encoded = string(b)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("secrets key must be 32 bytes encoded in base64")
+	}
+	var key [32]byte
+	copy(key[:], b)
+	return &key, nil
+}
+
+func generateSecretsKey(path string) (*[32]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := checkKeyUncommitted(path); err != nil {
+		return nil, err
+	}
+
+	var key [32]byte
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key[:]) + "\n"
+	if err := ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, err
+	}
+	Log(fmt.Sprintf("Generated secrets key %s, keep it out of the repository", path))
+	return &key, nil
+}
+
+// checkKeyUncommitted refuses a key path in a git work tree that git does
+// not ignore, where the key would be one git add away from being committed.
+func checkKeyUncommitted(path string) error {
+	// check-ignore exits 0 for an ignored path, 1 for one that is not, and
+	// 128 outside a work tree
+	err := CmdExec(context.Background(), filepath.Dir(path), "git", "check-ignore", "-q", path)
+	if IsExitStatus(err, 1) {
+		return fmt.Errorf("refusing to generate the secrets key %s in a git work tree, add it to .gitignore or set secrets_key_file outside the repository", path)
+	}
+	return nil
+}
+
+func encryptSecrets(key *[32]byte, plain []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	box := secretbox.Seal(nonce[:], plain, &nonce, key)
+	return []byte(SECRETS_HEADER + base64.StdEncoding.EncodeToString(box) + "\n"), nil
+}
+
+func decryptSecrets(key *[32]byte, data []byte) ([]byte, error) {
+	s := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(s, SECRETS_HEADER) {
+		return nil, errors.New("not a cap secrets file")
+	}
+	box, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, SECRETS_HEADER))
+	if err != nil || len(box) < 24 {
+		return nil, errors.New("corrupt secrets file")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box[:24])
+	plain, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return nil, errors.New("cannot decrypt secrets, wrong key?")
+	}
+	return plain, nil
+}
+
+// loadSecrets decrypts the secrets file at path, if there is one, into a
+// config layer and registers every value in it for redaction.
+func loadSecrets(path string, key func() (*[32]byte, error)) (*configLayer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := key()
+	if err != nil {
+		return nil, err
+	}
+	plain, err := decryptSecrets(k, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	table, err := decodeLayer(path, plain)
+	if err != nil {
+		return nil, err
+	}
+	registerSecretValues(table)
+
+	return &configLayer{path, table}, nil
+}
+
+// registerSecretValues marks every string in v as secret. For KEY=VALUE
+// entries, as in env, only the value is.
+func registerSecretValues(v interface{}) {
+	switch t := v.(type) {
+	case string:
+		if kv := strings.SplitN(t, "=", 2); len(kv) == 2 && envName.MatchString(kv[0]) {
+			AddSecret(kv[1])
+		} else {
+			AddSecret(t)
+		}
+	case map[string]interface{}:
+		for _, child := range t {
+			registerSecretValues(child)
+		}
+	case []map[string]interface{}:
+		for _, child := range t {
+			registerSecretValues(child)
+		}
+	case []interface{}:
+		for _, child := range t {
+			registerSecretValues(child)
+		}
+	}
+}
+
+// secretsTarget returns the secrets file of the selected stage and the key
+// path, reading deploy.toml only so that a broken stage config can still be
+// fixed.
+func secretsTarget(c *cli.Context) (path, keyPath string, err error) {
+	base, err := loadBase()
+	if err != nil {
+		return "", "", err
+	}
+	stageDir, _ := base["stage_dir"].(string)
+	return secretsPath(stageDir, c.GlobalString("stage")), secretsKeyPath(base), nil
+}
+
+func capSecretsEdit(c *cli.Context) error {
+	path, keyPath, err := secretsTarget(c)
+	if err != nil {
+		return err
+	}
+	key, err := loadSecretsKey(keyPath, true)
+	if err != nil {
+		return err
+	}
+
+	plain := []byte{}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if plain, err = decryptSecrets(key, data); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "cap-secrets-*.toml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(plain)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+" "+ShellQuote(f.Name()))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %s", editor, err)
+	}
+
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plain) {
+		Log("Secrets unchanged")
+		return nil
+	}
+	return writeSecrets(key, path, edited)
+}
+
+// capSecretsEncrypt encrypts the plaintext TOML file given as argument, or
+// stdin, into the secrets file of the stage.
+func capSecretsEncrypt(c *cli.Context) error {
+	path, keyPath, err := secretsTarget(c)
+	if err != nil {
+		return err
+	}
+	key, err := loadSecretsKey(keyPath, true)
+	if err != nil {
+		return err
+	}
+
+	var plain []byte
+	if src := c.Args().First(); src != "" {
+		plain, err = ioutil.ReadFile(src)
+	} else {
+		plain, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	return writeSecrets(key, path, plain)
+}
+
+func writeSecrets(key *[32]byte, path string, plain []byte) error {
+	if _, err := toml.Decode(string(plain), &map[string]interface{}{}); err != nil {
+		return fmt.Errorf("secrets are not valid TOML, nothing written: %s", err)
+	}
+	data, err := encryptSecrets(key, plain)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	Log(fmt.Sprintf("Wrote %s", path))
+	return nil
+}
+
+func capSecretsDecrypt(c *cli.Context) error {
+	path, keyPath, err := secretsTarget(c)
+	if err != nil {
+		return err
+	}
+	key, err := loadSecretsKey(keyPath, false)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	plain, err := decryptSecrets(key, data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	_, err = os.Stdout.Write(plain)
+	return err
+}
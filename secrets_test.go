@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecretsKeyPath(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", "/home/deploy/.config")
+	for _, tt := range []struct {
+		base map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"git_repo_url": "git@github.com:acme/shop.git"}, "/home/deploy/.config/cap/shop.key"},
+		{map[string]interface{}{"git_repo_url": "https://github.com/acme/blog"}, "/home/deploy/.config/cap/blog.key"},
+		{map[string]interface{}{"git_repo_url": "/srv/git/app.git"}, "/home/deploy/.config/cap/app.key"},
+		{map[string]interface{}{"git_repo_url": "/srv/git/app.git", "secrets_key_file": "/etc/cap/app.key"}, "/etc/cap/app.key"},
+	} {
+		if got := secretsKeyPath(tt.base); got != tt.want {
+			t.Errorf("secretsKeyPath(%v) = %s, want %s", tt.base, got, tt.want)
+		}
+	}
+
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("HOME", "/home/deploy")
+	wd, _ := os.Getwd()
+	if got, want := secretsKeyPath(map[string]interface{}{}), "/home/deploy/.config/cap/"+filepath.Base(wd)+".key"; got != want {
+		t.Errorf("secretsKeyPath without git_repo_url = %s, want %s", got, want)
+	}
+}
+
+func TestGenerateSecretsKeyInRepo(t *testing.T) {
+	logLevel = LOG_CRIT
+	repo := t.TempDir()
+	runGit(t, repo, "init", "-q")
+
+	path := filepath.Join(repo, "config", "secrets.key")
+	if _, err := generateSecretsKey(path); err == nil || IsExist(path) {
+		t.Errorf("generated a key that git would commit, err = %v", err)
+	}
+
+	writeFile(t, filepath.Join(repo, ".gitignore"), "/config/secrets.key\n")
+	if _, err := generateSecretsKey(path); err != nil {
+		t.Errorf("ignored key: %v", err)
+	}
+
+	outside := filepath.Join(t.TempDir(), "cap", "app.key")
+	if _, err := generateSecretsKey(outside); err != nil {
+		t.Errorf("key outside a repo: %v", err)
+	}
+	if fi, err := os.Stat(outside); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key mode %v, %v", fi, err)
+	}
+}
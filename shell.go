@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+	envName   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// ShellQuote quotes s so that a POSIX shell reads it back as one word.
+func ShellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+type simpleCommand struct {
+	env      []string
+	args     []string
+	redirect string
+	appendTo bool
+}
+
+func (s simpleCommand) String() string {
+	words := append(append([]string{}, s.env...), s.args...)
+	if s.redirect != "" {
+		op := ">"
+		if s.appendTo {
+			op = ">>"
+		}
+		words = append(words, op, s.redirect)
+	}
+	return strings.Join(words, " ")
+}
+
+// Command is a shell command line for remote execution, built from simple
+// commands joined with &&, ||, | and ;. Arguments, environment values and
+// redirect targets are always quoted; only Raw fragments are passed as is.
+type Command struct {
+	cmds []simpleCommand
+	ops  []string
+	err  error
+}
+
+// Sh starts a command line with the simple command name args.
+func Sh(name string, args ...string) *Command {
+	c := &Command{}
+	return c.next("", name, args)
+}
+
+// Cd starts a command line that changes to dir.
+func Cd(dir string) *Command {
+	return Sh("cd", dir)
+}
+
+func (c *Command) next(op, name string, args []string) *Command {
+	if op != "" {
+		c.ops = append(c.ops, op)
+	}
+	c.cmds = append(c.cmds, simpleCommand{})
+	return c.Arg(name).Arg(args...)
+}
+
+func (c *Command) last() *simpleCommand {
+	return &c.cmds[len(c.cmds)-1]
+}
+
+// Arg appends quoted arguments to the current simple command.
+func (c *Command) Arg(args ...string) *Command {
+	last := c.last()
+	for _, v := range args {
+		last.args = append(last.args, ShellQuote(v))
+	}
+	return c
+}
+
+// Raw appends s unquoted to the current simple command, for trusted
+// fragments such as globs.
+func (c *Command) Raw(s string) *Command {
+	last := c.last()
+	last.args = append(last.args, s)
+	return c
+}
+
+// Env sets an environment variable for the current simple command.
+func (c *Command) Env(key, value string) *Command {
+	if !envName.MatchString(key) {
+		if c.err == nil {
+			c.err = fmt.Errorf("invalid environment variable name %q", key)
+		}
+		return c
+	}
+	last := c.last()
+	last.env = append(last.env, key+"="+ShellQuote(value))
+	return c
+}
+
+// EnvList sets KEY=VALUE entries for the current simple command.
+func (c *Command) EnvList(env []string) *Command {
+	for _, v := range env {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			if c.err == nil {
+				c.err = fmt.Errorf("invalid environment entry %q", v)
+			}
+			continue
+		}
+		c.Env(kv[0], kv[1])
+	}
+	return c
+}
+
+// To redirects the stdout of the current simple command to path.
+func (c *Command) To(path string) *Command {
+	c.last().redirect = ShellQuote(path)
+	c.last().appendTo = false
+	return c
+}
+
+// AppendTo appends the stdout of the current simple command to path.
+func (c *Command) AppendTo(path string) *Command {
+	c.last().redirect = ShellQuote(path)
+	c.last().appendTo = true
+	return c
+}
+
+// And runs name args if the command line so far succeeded.
+func (c *Command) And(name string, args ...string) *Command {
+	return c.next("&&", name, args)
+}
+
+// Or runs name args if the command line so far failed.
+func (c *Command) Or(name string, args ...string) *Command {
+	return c.next("||", name, args)
+}
+
+// Pipe feeds the stdout of the command line so far to name args.
+func (c *Command) Pipe(name string, args ...string) *Command {
+	return c.next("|", name, args)
+}
+
+// Then runs name args after the command line so far, whatever its status.
+func (c *Command) Then(name string, args ...string) *Command {
+	return c.next(";", name, args)
+}
+
+// Err returns the first error found while building the command line.
+func (c *Command) Err() error {
+	return c.err
+}
+
+func (c *Command) String() string {
+	words := []string{c.cmds[0].String()}
+	for i, op := range c.ops {
+		words = append(words, op, c.cmds[i+1].String())
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os/exec"
+	"testing"
+)
+
+var hostileValues = []string{
+	"",
+	"plain",
+	"with space",
+	"two  spaces",
+	"it's",
+	`double "quotes"`,
+	"$HOME",
+	"${PATH}",
+	"`id`",
+	"$(id)",
+	"a\nb",
+	"tab\there",
+	"semi;colon",
+	"pipe|and&",
+	"glob*?[x]",
+	"back\\slash",
+	"'",
+	"''",
+	"-rf",
+	"~",
+}
+
+func TestShellQuoteRoundTrip(t *testing.T) {
+	for _, v := range hostileValues {
+		out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(v)).Output()
+		if err != nil {
+			t.Fatalf("ShellQuote(%q) = %s: %s", v, ShellQuote(v), err)
+		}
+		if string(out) != v {
+			t.Errorf("ShellQuote(%q) = %s, sh read back %q", v, ShellQuote(v), out)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"/var/www/app", "/var/www/app"},
+		{"u:www-data:rwX", "u:www-data:rwX"},
+		{"with space", "'with space'"},
+		{"it's", `'it'\''s'`},
+		{"$HOME", "'$HOME'"},
+		{"`id`", "'`id`'"},
+		{"a\nb", "'a\nb'"},
+	} {
+		if got := ShellQuote(tt.in); got != tt.want {
+			t.Errorf("ShellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cmd  *Command
+		want string
+	}{
+		{"args", Sh("mkdir", "-p", "/srv/my app"), "mkdir -p '/srv/my app'"},
+		{"and", Sh("rm", "-f", "cur").And("ln", "-vs", "rel", "cur"), "rm -f cur && ln -vs rel cur"},
+		{"or", Sh("test", "!", "-d", "d").Or("rm", "-rf", "d"), "test '!' -d d || rm -rf d"},
+		{"pipe", Sh("ls", "-1dt").Pipe("tail", "-n", "+3").Pipe("xargs", "rm", "-rf"), "ls -1dt | tail -n +3 | xargs rm -rf"},
+		{"then", Sh("true").Then("false"), "true ; false"},
+		{"to", Sh("echo", "$rev").To("/srv/a b/REVISION"), "echo '$rev' > '/srv/a b/REVISION'"},
+		{"append to", Sh("echo", "line").AppendTo("/srv/revisions.log"), "echo line >> /srv/revisions.log"},
+		{"cd", Cd("/srv/it's").And("php", "composer.phar"), `cd '/srv/it'\''s' && php composer.phar`},
+		{"env", Sh("php").Env("DB_PASSWORD", "p$ss word"), "DB_PASSWORD='p$ss word' php"},
+		{"env list", Sh("php").EnvList([]string{"A=1", "B=`id`"}), "A=1 B='`id`' php"},
+		{"raw", Sh("ls").Raw("/srv/releases/*"), "ls /srv/releases/*"},
+		{"arg", Sh("install").Arg("--no-dev", "a;b"), "install --no-dev 'a;b'"},
+	} {
+		if err := tt.cmd.Err(); err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+		}
+		if got := tt.cmd.String(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCommandHostileArgs(t *testing.T) {
+	for _, v := range hostileValues {
+		cmd := Sh("printf", "%s|", v).And("sh", "-c", `printf %s "$V"`).Env("V", v)
+		out, err := exec.Command("sh", "-c", cmd.String()).Output()
+		if err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+		if want := v + "|" + v; string(out) != want {
+			t.Errorf("%s: got %q, want %q", cmd, out, want)
+		}
+	}
+}
+
+func TestCommandInvalidEnv(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cmd  *Command
+	}{
+		{"empty name", Sh("php").Env("", "x")},
+		{"space", Sh("php").Env("A B", "x")},
+		{"injection", Sh("php").Env("A=1;id;B", "x")},
+		{"leading digit", Sh("php").Env("1A", "x")},
+		{"dollar", Sh("php").Env("$A", "x")},
+		{"no equals", Sh("php").EnvList([]string{"NOVALUE"})},
+		{"bad list name", Sh("php").EnvList([]string{"A B=1"})},
+	} {
+		if tt.cmd.Err() == nil {
+			t.Errorf("%s: no error for %s", tt.name, tt.cmd)
+		}
+	}
+
+	r := &RecordingExecutor{}
+	r.Run(Sh("php").Env("A;id", "x"))
+	if r.Err() == nil || len(r.Commands) != 0 {
+		t.Errorf("a command with an invalid env name was run: %v", r.Commands)
+	}
+}
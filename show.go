@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/codegangsta/cli"
+)
+
+func capConfigShow(c *cli.Context) error {
+	if err := setupStage(c); err != nil {
+		return err
+	}
+
+	shown, err := effectiveConfig(config, c.String("host"))
+	if err != nil {
+		return err
+	}
+
+	switch c.String("format") {
+	case "json":
+		b, err := json.MarshalIndent(shown, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	case "toml":
+		return toml.NewEncoder(os.Stdout).Encode(shown)
+	default:
+		return fmt.Errorf("unknown format %q, use toml or json", c.String("format"))
+	}
+}
+
+// effectiveConfig returns conf as cap uses it, keyed like the config files,
+// with each server resolved against ssh config and secrets redacted. When
+// host is set only that server is included.
+func effectiveConfig(conf *Config, host string) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(conf); err != nil {
+		return nil, err
+	}
+	table := map[string]interface{}{}
+	if _, err := toml.Decode(buf.String(), &table); err != nil {
+		return nil, err
+	}
+
+	if conf.SSHPass != "" {
+		table["ssh_pass"] = REDACTED
+	}
+	table["env"] = redactEnv(conf.Env)
+
+	servers := []map[string]interface{}{}
+	for _, s := range conf.Servers {
+		if host != "" && s.Host != host {
+			continue
+		}
+		servers = append(servers, effectiveServer(s))
+	}
+	if host != "" && len(servers) == 0 {
+		return nil, fmt.Errorf("no server %s in this stage", host)
+	}
+	table["servers"] = servers
+
+	return redactValue(table).(map[string]interface{}), nil
+}
+
+// redactValue masks the registered secrets, such as those decrypted from
+// the stage secrets file, in every string of v.
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return Redact(t)
+	case []string:
+		for i, child := range t {
+			t[i] = Redact(child)
+		}
+		return t
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = redactValue(child)
+		}
+		return t
+	case []map[string]interface{}:
+		for _, child := range t {
+			redactValue(child)
+		}
+		return t
+	case []interface{}:
+		for i, child := range t {
+			t[i] = redactValue(child)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+func effectiveServer(s server) map[string]interface{} {
+	transport := s.Transport
+	if transport == "" {
+		transport = TRANSPORT_SSH
+	}
+	ret := map[string]interface{}{
+		"host":      s.Host,
+		"transport": transport,
+		"web_user":  s.WebUser,
+		"php_bin":   s.PHPBin,
+	}
+	if len(s.Roles) > 0 {
+		ret["roles"] = s.Roles
+	}
+	sources := map[string]string{}
+	for _, key := range []string{"web_user", "php_bin"} {
+		if v, ok := s.Sources[key]; ok {
+			sources[key] = v
+		}
+	}
+
+	if transport == TRANSPORT_SSH {
+		h, hostSources := resolveHost(s)
+		ret["hostname"] = h.HostName
+		ret["port"] = h.Port
+		ret["user"] = h.User
+		ret["identity_file"] = h.IdentityFile
+		for k, v := range hostSources {
+			sources[k] = v
+		}
+		if s.Pass != "" {
+			ret["pass"] = REDACTED
+			sources["pass"] = s.Sources["pass"]
+		}
+	}
+	ret["sources"] = sources
+
+	return ret
+}
+
+// redactEnv masks the values of KEY=VALUE entries whose key looks secret.
+func redactEnv(env []string) []string {
+	ret := make([]string, 0, len(env))
+	for _, v := range env {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 && secretEnvName.MatchString(kv[0]) {
+			v = kv[0] + "=" + REDACTED
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
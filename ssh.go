@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
@@ -11,8 +13,10 @@ import (
 	"sort"
 	"strings"
 	"strconv"
+	"time"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 var (
@@ -65,51 +69,168 @@ func (f SshConfigFile) Swap(i, j int) {
 	f[i], f[j] = f[j], f[i]
 }
 
+// SshConnection is the Executor for a server reached over ssh.
 type SshConnection struct {
 	Client *ssh.Client
-	Host *SshConfigHost
-	Err error
+	Config *SshConfigHost
+	// pass is ssh_pass, for the ssh connection of rsync.
+	pass string
+	err error
+	ctx context.Context
+	stop <-chan struct{}
 }
 
-func (conn *SshConnection) Exec(name string, args ...string) string {
-	if conn.Err != nil {
+func (conn *SshConnection) Run(c *Command) {
+	conn.Output(c)
+}
+
+// Output runs the command line c on the remote host and returns its stdout.
+func (conn *SshConnection) Output(c *Command) string {
+	return conn.run(c, nil)
+}
+
+// run runs c on the remote host with stdin as its input, if not nil, and
+// returns its stdout.
+func (conn *SshConnection) run(c *Command, stdin io.Reader) string {
+	if conn.err != nil {
+		return ""
+	}
+	if conn.err = c.Err(); conn.err != nil {
+		return ""
+	}
+	if conn.err = checkInterrupted(conn.stop); conn.err != nil {
 		return ""
 	}
 	var sess *ssh.Session
 
-	sess, conn.Err = conn.Client.NewSession()
-	if conn.Err != nil {
+	sess, conn.err = conn.Client.NewSession()
+	if conn.err != nil {
 		return ""
 	}
 	defer sess.Close()
 
-	var stdout, stderr bytes.Buffer
-	sess.Stdout = &stdout
-	sess.Stderr = &stderr
+	ctx, cancel := withCommandTimeout(conn.ctx)
+	defer cancel()
+
+	cmd := c.String()
+	LogCmd(conn.Host(), cmd)
+
+	hb := startHeartbeat(conn.Host(), cmd)
+	defer hb.Stop()
+	stdout := newLineWriter(conn.Host(), hb)
+	stderr := newLineWriter(conn.Host(), hb)
+	sess.Stdin = stdin
+	sess.Stdout = stdout
+	sess.Stderr = stderr
 
-	cmd := strings.Join(append([]string{name}, args...), " ")
-	LogCmd(conn.Host.Host, cmd)
-	conn.Err = sess.Run(cmd)
-	if conn.Err != nil {
-		conn.Err = errors.New(Chomp(stderr.String()))
+	conn.err = sess.Start(cmd)
+	if conn.err == nil {
+		conn.err = waitSession(ctx, sess)
+	}
+	stdout.Flush()
+	stderr.Flush()
+	if conn.err != nil {
+		conn.err = newCmdError(conn.Host(), cmd, conn.err, stdout.String(), stderr.String())
 		return ""
 	}
 
-	ret := Chomp(stdout.String())
-	if len(ret) > 0 {
-		LogOut(conn.Host.Host, ret)
+	return Chomp(stdout.String())
+}
+
+func (conn *SshConnection) Exists(path string) bool {
+	return exists(conn, path)
+}
+
+// Upload rsyncs src from this machine into dst on the remote host. The
+// remote shell of rsync is cap itself, see rsh, so that rsync reaches the
+// host with the same address, credentials and host keys as commands.
+func (conn *SshConnection) Upload(src, dst string) {
+	if conn.err != nil {
+		return
 	}
-	return ret
+	exe, err := os.Executable()
+	if err != nil {
+		conn.err = err
+		return
+	}
+	target, err := json.Marshal(&rshTarget{
+		Host:          *conn.Config,
+		Pass:          conn.pass,
+		KnownHosts:    config.SSHKnownHosts,
+		IgnoreHostKey: config.SSHIgnoreHostKey,
+		Timeout:       dialTimeout,
+	})
+	if err != nil {
+		conn.err = err
+		return
+	}
+	remote := fmt.Sprintf("%s@%s:%s", conn.Config.User, conn.Config.HostName, dst)
+
+	cli := &Cmd{ctx: conn.ctx, Env: []string{ENV_RSH + "=" + string(target)}}
+	cli.Exec("rsync", "-lrptauz", "--delete", "-e", ShellQuote(exe), src+"/", remote)
+	conn.err = cli.Err()
 }
 
-func (conn *SshConnection) SshIsExist(path string) bool {
-	if conn.Err != nil {
-		return false
+// WriteFile streams data into path on the remote host through cat.
+func (conn *SshConnection) WriteFile(path string, data []byte) {
+	conn.run(Sh("cat").To(path), bytes.NewReader(data))
+}
+
+func (conn *SshConnection) Host() string {
+	return conn.Config.Host
+}
+
+func (conn *SshConnection) User() string {
+	return conn.Config.User
+}
+
+func (conn *SshConnection) Err() error {
+	return conn.err
+}
+
+func (conn *SshConnection) SetErr(err error) {
+	conn.err = err
+}
+
+func (conn *SshConnection) Reset() {
+	// without a connection there is nothing to run
+	if conn.Client != nil {
+		conn.err = nil
 	}
-	out := conn.Exec(fmt.Sprintf("if [ -e '%s' ]; then echo -n 'true'; fi", path) )
-	return out == "true"
+	conn.ctx = context.Background()
+	conn.stop = nil
 }
 
+func (conn *SshConnection) Close() error {
+	if conn.Client == nil {
+		return nil
+	}
+	return conn.Client.Close()
+}
+
+// waitSession waits for the command started in sess, signalling it when
+// ctx is done.
+func waitSession(ctx context.Context, sess *ssh.Session) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	sess.Signal(ssh.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(KILL_GRACE):
+		sess.Signal(ssh.SIGKILL)
+		sess.Close()
+	}
+	return ctx.Err()
+}
 
 func init() {
 	path := filepath.Join(os.Getenv("HOME"), ".ssh", "config")
@@ -170,34 +291,129 @@ func getSshConfigHost(host string) *SshConfigHost {
 	return &configHost
 }
 
-func loadIdentity(path string) ([]byte, error) {
+func expandHome(path string) string {
 	if strings.HasPrefix(path, "~") {
 		path = strings.Replace(path, "~", os.Getenv("HOME"), 1)
 	}
-	return ioutil.ReadFile(path)
+	return path
 }
 
-func newConnection(s server) (*SshConnection) {
+func loadIdentity(path string) ([]byte, error) {
+	return ioutil.ReadFile(expandHome(path))
+}
+
+// resolveHost merges server s with its ssh config entry, and reports for
+// hostname, port, user and identity_file where the value came from.
+func resolveHost(s server) (*SshConfigHost, map[string]string) {
 	h := getSshConfigHost(s.Host)
+	sources := map[string]string{}
+	for key, set := range map[string]bool{
+		"hostname": h.HostName != "",
+		"port": h.Port != 0,
+		"user": h.User != "",
+		"identity_file": h.IdentityFile != "",
+	} {
+		if set {
+			sources[key] = "ssh config"
+		}
+	}
+
+	if h.HostName == "" {
+		h.HostName = s.Host
+		sources["hostname"] = "host"
+	}
 	if s.Port != 0 {
 		h.Port = s.Port
+		sources["port"] = s.Sources["port"]
+	}
+	if h.Port == 0 {
+		h.Port = 22
+		sources["port"] = "default"
 	}
 	if s.User != "" {
 		h.User = s.User
+		sources["user"] = s.Sources["user"]
 	}
+	return h, sources
+}
 
-	signer, err := h.GetSigner()
+func newConnection(ctx context.Context, s server) (*SshConnection) {
+	h, _ := resolveHost(s)
+	cli, err := dialHost(ctx, h, s.Pass, config.SSHKnownHosts, config.SSHIgnoreHostKey, dialTimeout)
+	return &SshConnection{Client: cli, Config: h, pass: s.Pass, err: err, ctx: ctx, stop: interrupted}
+}
+
+// dialHost connects to the resolved host h, authenticating with its identity
+// file or pass.
+func dialHost(ctx context.Context, h *SshConfigHost, pass, knownHosts string, ignoreHostKey bool, timeout time.Duration) (*ssh.Client, error) {
+	auth, err := authMethods(h, pass)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+	hostKey, err := hostKeyCallback(knownHosts, ignoreHostKey)
+	if err != nil {
+		return nil, err
 	}
 
 	config := &ssh.ClientConfig{
 		User: h.User,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
+		Auth: auth,
+		HostKeyCallback: hostKey,
+		Timeout: timeout,
+	}
+	return dialContext(ctx, net.JoinHostPort(h.HostName, strconv.Itoa(h.Port)), config)
+}
+
+// authMethods offers the identity file of h and then pass, when set.
+func authMethods(h *SshConfigHost, pass string) ([]ssh.AuthMethod, error) {
+	auth := []ssh.AuthMethod{}
+	if h.IdentityFile != "" {
+		signer, err := h.GetSigner()
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if pass != "" {
+		auth = append(auth, ssh.Password(pass))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("no IdentityFile in ssh config and no ssh_pass for %s", h.Host)
+	}
+	return auth, nil
+}
+
+// hostKeyCallback checks host keys against path, ssh_known_hosts, which
+// defaults to ~/.ssh/known_hosts, unless ssh_ignore_host_key is set.
+func hostKeyCallback(path string, ignore bool) (ssh.HostKeyCallback, error) {
+	if ignore {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	if path == "" {
+		path = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
 	}
-	cli, err := ssh.Dial("tcp", net.JoinHostPort(h.HostName, strconv.Itoa(h.Port)), config)
-	return &SshConnection{Client: cli, Host: h, Err: err}
+	return knownhosts.New(expandHome(path))
+}
+
+// dialContext connects and completes the ssh handshake within
+// config.Timeout, giving up early when ctx is done.
+func dialContext(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	d := net.Dialer{Timeout: config.Timeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		nc.SetDeadline(time.Now().Add(config.Timeout))
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(nc, addr, config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
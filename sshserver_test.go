@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an ssh server in the test process that stands in for a
+// remote host. It runs each command with sh in Dir, with Bin first in PATH.
+type testSSHServer struct {
+	Host string
+	Port int
+	User string
+	Pass string
+	// KnownHosts is a known_hosts file with the key of the server.
+	KnownHosts string
+	Dir        string
+	Bin        string
+
+	listener net.Listener
+}
+
+func startSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	root := t.TempDir()
+	srv := &testSSHServer{
+		Host:       "127.0.0.1",
+		Port:       l.Addr().(*net.TCPAddr).Port,
+		User:       "deploy",
+		Pass:       "test-ssh-pass",
+		KnownHosts: filepath.Join(root, "known_hosts"),
+		Dir:        filepath.Join(root, "remote"),
+		Bin:        filepath.Join(root, "bin"),
+		listener:   l,
+	}
+	for _, dir := range []string{srv.Dir, srv.Bin} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, signer.PublicKey())
+	if err := ioutil.WriteFile(srv.KnownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == srv.User && string(pass) == srv.Pass {
+				return nil, nil
+			}
+			return nil, errors.New("permission denied")
+		},
+	}
+	conf.AddHostKey(signer)
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.serve(nc, conf)
+		}
+	}()
+	return srv
+}
+
+// addCommand installs an executable script named name in Bin.
+func (srv *testSSHServer) addCommand(t *testing.T, name, script string) {
+	t.Helper()
+	path := filepath.Join(srv.Bin, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (srv *testSSHServer) serve(nc net.Conn, conf *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, conf)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+		go srv.session(ch, reqs)
+	}
+}
+
+// session runs the exec request of a session channel, and forwards the
+// signals the client sends to it.
+func (srv *testSSHServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	var cmd *exec.Cmd
+
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if cmd != nil || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Dir = srv.Dir
+			cmd.Env = append(os.Environ(), "PATH="+srv.Bin+":"+os.Getenv("PATH"))
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			stdin, err := cmd.StdinPipe()
+			if err == nil {
+				err = cmd.Start()
+			}
+			req.Reply(err == nil, nil)
+			if err != nil {
+				ch.Close()
+				continue
+			}
+
+			go func() {
+				io.Copy(stdin, ch)
+				stdin.Close()
+			}()
+			go func(cmd *exec.Cmd) {
+				status := 0
+				if err := cmd.Wait(); err != nil {
+					status = 255
+					var exitErr *exec.ExitError
+					if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+						status = exitErr.ExitCode()
+					}
+				}
+				ch.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{uint32(status)}))
+				ch.Close()
+			}(cmd)
+		case "signal":
+			var payload struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &payload)
+			sig := map[string]syscall.Signal{"TERM": syscall.SIGTERM, "KILL": syscall.SIGKILL, "INT": syscall.SIGINT}[payload.Signal]
+			if cmd != nil && cmd.Process != nil && sig != 0 {
+				cmd.Process.Signal(sig)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// installRsync puts first in PATH a stand-in for rsync, which is not
+// installed everywhere the tests run. It sends SRC/ to [USER@]HOST:DST as a
+// tar stream through the remote shell given with -e, and appends its
+// arguments to rsync.args next to it. It returns the dir it is in.
+func installRsync(t *testing.T) string {
+	t.Helper()
+	bin := t.TempDir()
+	script := `#!/bin/sh
+echo "$@" >> "$(dirname "$0")/rsync.args"
+while [ $# -gt 2 ]; do
+	if [ "$1" = -e ]; then rsh=$2; shift; fi
+	shift
+done
+dst=${2#*:}
+tar -C "$1" -c . | $rsh host "rm -rf '$dst' && mkdir -p '$dst' && tar -x -C '$dst'"
+`
+	if err := ioutil.WriteFile(filepath.Join(bin, "rsync"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	return bin
+}
+
+// server is the config entry for the test server.
+func (srv *testSSHServer) server() server {
+	return server{Host: srv.Host, Port: srv.Port, User: srv.User, Pass: srv.Pass}
+}
+
+func (srv *testSSHServer) stanza() string {
+	return "[[servers]]\n" +
+		"host = " + strconv.Quote(srv.Host) + "\n" +
+		"port = " + strconv.Itoa(srv.Port) + "\n" +
+		"user = " + strconv.Quote(srv.User) + "\n" +
+		"pass = " + strconv.Quote(srv.Pass) + "\n"
+}
+
+func TestSSHConnection(t *testing.T) {
+	srv := startSSHServer(t)
+	testConfig()
+	config.SSHKnownHosts = srv.KnownHosts
+	sshConfig = SshConfigFile{}
+
+	conn := newConnection(context.Background(), srv.server())
+	defer conn.Close()
+	if conn.Err() != nil {
+		t.Fatal(conn.Err())
+	}
+
+	if got := conn.Output(Sh("echo", "it's $HOME")); got != "it's $HOME" {
+		t.Errorf("Output = %q", got)
+	}
+	if got := conn.Output(Sh("pwd")); got != srv.Dir {
+		t.Errorf("commands run in %s, want %s", got, srv.Dir)
+	}
+
+	dst := filepath.Join(srv.Dir, "dir with space", "file")
+	conn.Run(Sh("mkdir", "-p", filepath.Dir(dst)))
+	conn.WriteFile(dst, []byte("data\n"))
+	if b, err := ioutil.ReadFile(dst); err != nil || string(b) != "data\n" {
+		t.Errorf("WriteFile wrote %q, %v", b, err)
+	}
+	if !conn.Exists(dst) || conn.Exists(dst+".missing") {
+		t.Errorf("Exists is wrong")
+	}
+	if conn.Err() != nil {
+		t.Fatal(conn.Err())
+	}
+
+	conn.Run(Sh("sh", "-c", "echo oops >&2; exit 3"))
+	var e *CmdError
+	if !errors.As(conn.Err(), &e) || e.ExitStatus != 3 || e.Stderr != "oops" {
+		t.Errorf("Err = %#v, want exit status 3 with stderr", conn.Err())
+	}
+}
+
+func TestSSHConnectionAuth(t *testing.T) {
+	srv := startSSHServer(t)
+	testConfig()
+	sshConfig = SshConfigFile{}
+
+	config.SSHKnownHosts = srv.KnownHosts
+	s := srv.server()
+	s.Pass = "wrong"
+	if conn := newConnection(context.Background(), s); conn.Err() == nil {
+		t.Error("connected with a wrong password")
+	}
+
+	other := filepath.Join(t.TempDir(), "known_hosts")
+	ioutil.WriteFile(other, nil, 0644)
+	config.SSHKnownHosts = other
+	if conn := newConnection(context.Background(), srv.server()); conn.Err() == nil {
+		t.Error("connected to an unknown host key")
+	}
+}
+
+func TestSSHUpload(t *testing.T) {
+	srv := startSSHServer(t)
+	bin := installRsync(t)
+	testConfig()
+	config.SSHKnownHosts = srv.KnownHosts
+	sshConfig = SshConfigFile{}
+
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "app", "logs"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "index.php"), []byte("<?php\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "app", "console"), []byte("#!/bin/sh\n"), 0755)
+	os.Symlink("app/console", filepath.Join(src, "console"))
+
+	dst := filepath.Join(srv.Dir, "cached copy")
+	os.MkdirAll(dst, 0755)
+	ioutil.WriteFile(filepath.Join(dst, "stale"), nil, 0644)
+
+	conn := newConnection(context.Background(), srv.server())
+	defer conn.Close()
+	conn.Upload(src, dst)
+	if conn.Err() != nil {
+		t.Fatal(conn.Err())
+	}
+
+	if b, _ := ioutil.ReadFile(filepath.Join(dst, "index.php")); string(b) != "<?php\n" {
+		t.Errorf("index.php = %q", b)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "app", "console")); err != nil || fi.Mode().Perm() != 0755 {
+		t.Errorf("app/console was not uploaded with its mode: %v %v", fi, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "console")); err != nil || link != "app/console" {
+		t.Errorf("console link = %q, %v", link, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "app", "logs")); err != nil || !fi.IsDir() {
+		t.Errorf("empty dir app/logs was not uploaded")
+	}
+	if IsExist(filepath.Join(dst, "stale")) {
+		t.Errorf("a file missing from src was left in dst")
+	}
+
+	want := "-lrptauz --delete -e " + ShellQuote(os.Args[0]) + " " + src + "/ deploy@127.0.0.1:" + dst
+	if args := strings.TrimSpace(readFile(t, filepath.Join(bin, "rsync.args"))); args != want {
+		t.Errorf("rsync %s, want rsync %s", args, want)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+const (
+	// HEARTBEAT_INTERVAL is how long a command may stay silent before a
+	// "still running" line is logged for it.
+	HEARTBEAT_INTERVAL = 30 * time.Second
+)
+
+// lineWriter logs every complete line written to it as command output of
+// host, and keeps the full output for callers and error reporting.
+type lineWriter struct {
+	host string
+	hb   *heartbeat
+	buf  bytes.Buffer
+	line []byte
+}
+
+func newLineWriter(host string, hb *heartbeat) *lineWriter {
+	return &lineWriter{host: host, hb: hb}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if w.hb != nil {
+		w.hb.Touch()
+	}
+	w.buf.Write(p)
+	w.line = append(w.line, p...)
+	for {
+		i := bytes.IndexByte(w.line, '\n')
+		if i < 0 {
+			break
+		}
+		LogOut(w.host, string(bytes.TrimRight(w.line[:i], "\r")))
+		w.line = w.line[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs a trailing line that was not terminated by a newline.
+func (w *lineWriter) Flush() {
+	if len(w.line) > 0 {
+		LogOut(w.host, string(w.line))
+		w.line = nil
+	}
+}
+
+func (w *lineWriter) String() string {
+	return w.buf.String()
+}
+
+// heartbeat logs a "still running" line whenever the command it watches
+// has produced no output for HEARTBEAT_INTERVAL.
+type heartbeat struct {
+	host  string
+	cmd   string
+	start time.Time
+	mu    sync.Mutex
+	last  time.Time
+	done  chan struct{}
+}
+
+func startHeartbeat(host, cmd string) *heartbeat {
+	now := time.Now()
+	hb := &heartbeat{
+		host:  host,
+		cmd:   cmd,
+		start: now,
+		last:  now,
+		done:  make(chan struct{}),
+	}
+	go hb.run()
+	return hb
+}
+
+func (hb *heartbeat) run() {
+	t := time.NewTicker(HEARTBEAT_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-hb.done:
+			return
+		case now := <-t.C:
+			hb.mu.Lock()
+			silent := now.Sub(hb.last) >= HEARTBEAT_INTERVAL
+			hb.mu.Unlock()
+			if silent {
+				LogWait(hb.host, hb.cmd, now.Sub(hb.start))
+			}
+		}
+	}
+}
+
+func (hb *heartbeat) Touch() {
+	hb.mu.Lock()
+	hb.last = time.Now()
+	hb.mu.Unlock()
+}
+
+func (hb *heartbeat) Stop() {
+	close(hb.done)
+}
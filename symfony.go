@@ -20,7 +20,7 @@ func init() {
 	symfony_env_prod = "dev"
 }
 
-func Symfony(conn *SshConnection, path string) {
+func Symfony(conn Executor, path string) {
 	// symfony.assets.update_version
 	// symfony.assets.normalize_timestamps
 	SymfonyComposerInstall(conn, path)
@@ -32,117 +32,108 @@ func Symfony(conn *SshConnection, path string) {
 	SymfonyDeloySetPermission(conn, path)
 }
 
-func SymfonySetup (conn *SshConnection) {
+func SymfonySetup (conn Executor) {
 	SymfonyComposerGet(conn, sharedPath)
 }
 
-func SymfonyComposerInstall(conn *SshConnection, path string) {
+func SymfonyComposerInstall(conn Executor, path string) {
 	SymfonyVendorCopy(conn, path)
-	if conn.Err != nil {
+	if conn.Err() != nil {
 		return
 	}
 
+	step := LogInfo(conn.Host(), "Install composer dependencies")
 	defer func() {
-		lenText := LogInfo(conn.Host.Host, "Install composer dependencies")
-		if conn.Err != nil {
-			LogNG(lenText)
-			LogError(conn.Host.Host, conn.Err)
+		if conn.Err() != nil {
+			LogNG(step)
+			LogError(conn.Host(), conn.Err())
 			return
 		}
-		LogOK(lenText)
+		LogOK(step)
 	}()
 
-	env := make([]string, 0)
-	for _, v := range config.Env {
-		env = append(env, v)
-	}
-
 	composerOpt := OPT_COMPOSER
 	if symfony_env_prod == "dev" {
 		composerOpt = OPT_COMPOSER_DEV
 	}
 
-	conn.Exec(fmt.Sprintf(
-		"sh -c 'cd %s && %s SYMFONY_ENV=%s php %s/composer.phar install %s'",
-		path,
-		strings.Join(env, " "),
-		symfony_env_prod,
-		sharedPath,
-		composerOpt,
-	))
+	conn.Run(
+		Cd(path).
+			And("php", filepath.Join(sharedPath, "composer.phar"), "install").
+			Arg(strings.Fields(composerOpt)...).
+			EnvList(config.Env).
+			Env("SYMFONY_ENV", symfony_env_prod),
+	)
 }
 
-func SymfonyComposerGet(conn *SshConnection, path string) {
-	if conn.Err != nil {
+func SymfonyComposerGet(conn Executor, path string) {
+	if conn.Err() != nil {
 		return
 	}
 
+	step := LogInfo(conn.Host(), "Gets composer and installs it")
 	defer func() {
-		lenText := LogInfo(conn.Host.Host, "Gets composer and installs it")
-		if conn.Err != nil {
-			LogNG(lenText)
-			LogError(conn.Host.Host, conn.Err)
+		if conn.Err() != nil {
+			LogNG(step)
+			LogError(conn.Host(), conn.Err())
 			return
 		}
-		LogOK(lenText)
+		LogOK(step)
 	}()
 
-	opt := []string{}
-	if composer_version != "" {
-		opt = append(opt, fmt.Sprintf("-- --version=%s", composer_version))
-	}
-	if conn.SshIsExist(filepath.Join(path, "composer.phar")) {
-		conn.Exec(fmt.Sprintf(
-			"sh -c 'cd %s && php composer.phar self-update %s'",
-			path,
-			composer_version,
-		))
+	if conn.Exists(filepath.Join(path, "composer.phar")) {
+		cmd := Cd(path).And("php", "composer.phar", "self-update")
+		if composer_version != "" {
+			cmd.Arg(composer_version)
+		}
+		conn.Run(cmd)
 
 	} else {
-		conn.Exec(fmt.Sprintf(
-			"sh -c 'cd %s && curl -sSL https://getcomposer.org/installer | php %s'",
-			path,
-			strings.Join(opt, " "),
-		))
+		cmd := Cd(path).And("curl", "-sSL", "https://getcomposer.org/installer").Pipe("php")
+		if composer_version != "" {
+			cmd.Arg("--", fmt.Sprintf("--version=%s", composer_version))
+		}
+		conn.Run(cmd)
 	}
 }
 
-func SymfonyVendorCopy(conn *SshConnection, path string) {
-	if conn.Err != nil {
+func SymfonyVendorCopy(conn Executor, path string) {
+	if conn.Err() != nil {
 		return
 	}
 
+	step := LogInfo(conn.Host(), "Copy vendors from previous release")
 	defer func() {
-		lenText := LogInfo(conn.Host.Host, "Copy vendors from previous release")
-		if conn.Err != nil {
-			LogNG(lenText)
-			LogError(conn.Host.Host, conn.Err)
+		if conn.Err() != nil {
+			LogNG(step)
+			LogError(conn.Host(), conn.Err())
 			return
 		}
-		LogOK(lenText)
+		LogOK(step)
 	}()
 
-	conn.Exec(fmt.Sprintf(
-		"vendorDir=%s/vendor; if [ -d $vendorDir ] || [ -h $vendorDir ]; then cp -a $vendorDir %s; fi;",
-		pathCurrent(),
-		path,
-	))
+	vendorDir := filepath.Join(pathCurrent(), "vendor")
+	conn.Run(
+		Sh("test", "!", "-d", vendorDir).
+			And("test", "!", "-h", vendorDir).
+			Or("cp", "-a", vendorDir, path),
+	)
 }
 
-func SymfonyDeloySetPermission(conn *SshConnection, path string) {
-	if conn.Err != nil {
+func SymfonyDeloySetPermission(conn Executor, path string) {
+	if conn.Err() != nil {
 		return
 	}
 
 	// http://symfony.com/doc/master/book/installation.html#checking-symfony-application-configuration-and-setup
+	step := LogInfo(conn.Host(), "Sets permissions for writable_dirs")
 	defer func() {
-		lenText := LogInfo(conn.Host.Host, "Sets permissions for writable_dirs")
-		if conn.Err != nil {
-			LogNG(lenText)
-			LogError(conn.Host.Host, conn.Err)
+		if conn.Err() != nil {
+			LogNG(step)
+			LogError(conn.Host(), conn.Err())
 			return
 		}
-		LogOK(lenText)
+		LogOK(step)
 	}()
 
 	dirs := []string{}
@@ -155,26 +146,21 @@ func SymfonyDeloySetPermission(conn *SshConnection, path string) {
 	}
 
 	for _, v := range dirs {
-		out := conn.Exec(fmt.Sprintf("stat %s -c %%U", v))
-		if conn.Host.User == out {
-			out := conn.Exec(fmt.Sprintf(
-				"getfacl --absolute-names --tabular %s | grep %s.*rwx | wc -l",
-				v,
-				webUser,
-			))
-			if out == "0" {
-				conn.Exec(fmt.Sprintf(
-					"setfacl -R -m u:%s:rwX -m u:%s:rwX %s",
-					conn.Host.User,
-					webUser,
-					v,
-				))
-				conn.Exec(fmt.Sprintf(
-					"setfacl -dR -m u:%s:rwX -m u:%s:rwX %s",
-					conn.Host.User,
-					webUser,
-					v,
-				))
+		out := conn.Output(Sh("stat", v, "-c", "%U"))
+		if conn.User() == out {
+			conn.Run(
+				Sh("getfacl", "--absolute-names", "--tabular", v).
+					Pipe("grep", "-q", webUser+".*rwx"),
+			)
+			// grep exits 1 when web_user has no rwx entry yet
+			if IsExitStatus(conn.Err(), 1) {
+				conn.SetErr(nil)
+				acl := []string{
+					"-m", fmt.Sprintf("u:%s:rwX", conn.User()),
+					"-m", fmt.Sprintf("u:%s:rwX", webUser),
+				}
+				conn.Run(Sh("setfacl", append(append([]string{"-R"}, acl...), v)...))
+				conn.Run(Sh("setfacl", append(append([]string{"-dR"}, acl...), v)...))
 			}
 		}
 	}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSymfonyComposerInstall(t *testing.T) {
+	const rel = "/srv/app/releases/20240102030405"
+	vendor := "test '!' -d /srv/app/current/vendor && test '!' -h /srv/app/current/vendor || cp -a /srv/app/current/vendor " + rel
+
+	for _, tt := range []struct {
+		name   string
+		env    []string
+		errors map[string]error
+		want   []string
+	}{
+		{
+			name: "no env",
+			want: []string{
+				vendor,
+				"cd " + rel + " && SYMFONY_ENV=dev php /srv/app/shared/composer.phar install --prefer-dist --no-interaction --no-progress",
+			},
+		},
+		{
+			name: "env is quoted",
+			env:  []string{"DB_PASSWORD=pa$$ 'w0rd'", "DEBUG=0"},
+			want: []string{
+				vendor,
+				"cd " + rel + ` && DB_PASSWORD='pa$$ '\''w0rd'\''' DEBUG=0 SYMFONY_ENV=dev php /srv/app/shared/composer.phar install --prefer-dist --no-interaction --no-progress`,
+			},
+		},
+		{
+			name:   "vendor copy fails",
+			errors: map[string]error{vendor: exitStatus(1)},
+			want:   []string{vendor},
+		},
+		{
+			name: "invalid env name",
+			env:  []string{"BAD NAME=1"},
+			want: []string{vendor},
+		},
+	} {
+		testConfig()
+		config.Env = tt.env
+		r := &RecordingExecutor{Name: "web1", Errors: tt.errors}
+
+		SymfonyComposerInstall(r, rel)
+		if !reflect.DeepEqual(r.Commands, tt.want) {
+			t.Errorf("%s: commands\n got %q\nwant %q", tt.name, r.Commands, tt.want)
+		}
+	}
+}
+
+func TestSymfonyComposerGet(t *testing.T) {
+	const test = "test -e /srv/app/shared/composer.phar"
+
+	for _, tt := range []struct {
+		name    string
+		version string
+		errors  map[string]error
+		want    []string
+	}{
+		{
+			name: "self-update",
+			want: []string{test, "cd /srv/app/shared && php composer.phar self-update"},
+		},
+		{
+			name:    "self-update to version",
+			version: "1.10.1",
+			want:    []string{test, "cd /srv/app/shared && php composer.phar self-update 1.10.1"},
+		},
+		{
+			name:   "install",
+			errors: map[string]error{test: exitStatus(1)},
+			want:   []string{test, "cd /srv/app/shared && curl -sSL https://getcomposer.org/installer | php"},
+		},
+		{
+			name:    "install version",
+			version: "1.10.1",
+			errors:  map[string]error{test: exitStatus(1)},
+			want:    []string{test, "cd /srv/app/shared && curl -sSL https://getcomposer.org/installer | php -- --version=1.10.1"},
+		},
+	} {
+		testConfig()
+		composer_version = tt.version
+		r := &RecordingExecutor{Name: "web1", Errors: tt.errors}
+
+		SymfonySetup(r)
+		if !reflect.DeepEqual(r.Commands, tt.want) {
+			t.Errorf("%s: commands\n got %q\nwant %q", tt.name, r.Commands, tt.want)
+		}
+	}
+	composer_version = ""
+}
+
+func TestSymfonyDeloySetPermission(t *testing.T) {
+	const rel = "/srv/app/releases/20240102030405"
+	stat := func(dir string) string { return "stat " + dir + " -c %U" }
+	getfacl := func(dir string) string {
+		return "getfacl --absolute-names --tabular " + dir + " | grep -q 'www-data.*rwx'"
+	}
+	setfacl := func(flag, dir string) string {
+		return "setfacl " + flag + " -m u:deploy:rwX -m u:www-data:rwX " + dir
+	}
+
+	for _, tt := range []struct {
+		name         string
+		writableDirs []string
+		outputs      map[string]string
+		errors       map[string]error
+		want         []string
+		err          bool
+	}{
+		{
+			name: "no writable dirs",
+		},
+		{
+			name:         "sets acl on owned dirs",
+			writableDirs: []string{"app/logs", "app/cache"},
+			outputs: map[string]string{
+				stat("/srv/app/shared/app/logs"): "deploy",
+				stat(rel + "/app/cache"):         "deploy",
+			},
+			errors: map[string]error{
+				getfacl("/srv/app/shared/app/logs"): exitStatus(1),
+				getfacl(rel + "/app/cache"):         exitStatus(1),
+			},
+			want: []string{
+				stat("/srv/app/shared/app/logs"),
+				getfacl("/srv/app/shared/app/logs"),
+				setfacl("-R", "/srv/app/shared/app/logs"),
+				setfacl("-dR", "/srv/app/shared/app/logs"),
+				stat(rel + "/app/cache"),
+				getfacl(rel + "/app/cache"),
+				setfacl("-R", rel+"/app/cache"),
+				setfacl("-dR", rel+"/app/cache"),
+			},
+		},
+		{
+			name:         "acl already set",
+			writableDirs: []string{"app/cache"},
+			outputs:      map[string]string{stat(rel + "/app/cache"): "deploy"},
+			want:         []string{stat(rel + "/app/cache"), getfacl(rel + "/app/cache")},
+		},
+		{
+			name:         "owned by another user",
+			writableDirs: []string{"app/cache"},
+			outputs:      map[string]string{stat(rel + "/app/cache"): "root"},
+			want:         []string{stat(rel + "/app/cache")},
+		},
+		{
+			name:         "getfacl fails",
+			writableDirs: []string{"app/cache", "app/logs"},
+			outputs:      map[string]string{stat(rel + "/app/cache"): "deploy"},
+			errors:       map[string]error{getfacl(rel + "/app/cache"): exitStatus(2)},
+			want:         []string{stat(rel + "/app/cache"), getfacl(rel + "/app/cache")},
+			err:          true,
+		},
+	} {
+		testConfig()
+		sharedDirs = []string{"app/logs"}
+		writableDirs = tt.writableDirs
+		r := &RecordingExecutor{Name: "web1", UserName: "deploy", Outputs: tt.outputs, Errors: tt.errors}
+
+		SymfonyDeloySetPermission(r, rel)
+		if !reflect.DeepEqual(r.Commands, tt.want) {
+			t.Errorf("%s: commands\n got %q\nwant %q", tt.name, r.Commands, tt.want)
+		}
+		if (r.Err() != nil) != tt.err {
+			t.Errorf("%s: Err = %v", tt.name, r.Err())
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PATH_TRACE is where the deploy logs of this machine are kept.
+	PATH_TRACE = "log"
+	// DIR_REMOTE_TRACE is where each server keeps its part, in shared.
+	DIR_REMOTE_TRACE = "deploy-logs"
+)
+
+// The trace is the full record of a run, whatever the log level: every
+// step with its timing, command, output line and error. It is written to a
+// local file and kept per host, so each server can be given its part.
+var (
+	traceMu    sync.Mutex
+	traceFile  *os.File
+	hostTraces = map[string]*bytes.Buffer{}
+)
+
+// openTrace starts log/deploy-<stage>-<ts>.log and returns its path.
+func openTrace(stage, ts string) (string, error) {
+	if err := os.MkdirAll(PATH_TRACE, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(PATH_TRACE, fmt.Sprintf("deploy-%s-%s.log", stage, ts))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	traceMu.Lock()
+	traceFile = f
+	traceMu.Unlock()
+	return path, nil
+}
+
+func closeTrace() {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	if traceFile != nil {
+		traceFile.Close()
+		traceFile = nil
+	}
+}
+
+// trace records a line for host. Nothing is kept while no trace is open.
+func trace(host, format string, a ...interface{}) {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	if traceFile == nil {
+		return
+	}
+
+	msg := Redact(fmt.Sprintf(format, a...))
+	prefix := fmt.Sprintf("%s [%s] ", time.Now().Format("2006-01-02T15:04:05.000Z07:00"), host)
+	var b strings.Builder
+	for _, line := range strings.Split(msg, "\n") {
+		b.WriteString(prefix + line + "\n")
+	}
+
+	traceFile.WriteString(b.String())
+	buf, ok := hostTraces[host]
+	if !ok {
+		buf = &bytes.Buffer{}
+		hostTraces[host] = buf
+	}
+	buf.WriteString(b.String())
+}
+
+// hostTrace returns what has been traced for host so far.
+func hostTrace(host string) []byte {
+	traceMu.Lock()
+	defer traceMu.Unlock()
+	if buf, ok := hostTraces[host]; ok {
+		return append([]byte{}, buf.Bytes()...)
+	}
+	return nil
+}
+
+// uploadTrace leaves the part of the trace for conn's host in
+// shared/deploy-logs/<ts>.log on the host. It runs after the deploy of the
+// host is over, failed or not, on hosts that could be connected to.
+func uploadTrace(conn Executor, ts string) {
+	conn.Reset()
+	dir := filepath.Join(sharedPath, DIR_REMOTE_TRACE)
+	conn.Run(Sh("mkdir", "-p", dir))
+	conn.WriteFile(filepath.Join(dir, ts+".log"), hostTrace(conn.Host()))
+	if conn.Err() != nil {
+		LogError(conn.Host(), fmt.Errorf("upload deploy log: %s", conn.Err()))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/codegangsta/cli"
+	"github.com/fatih/color"
+)
+
+// ConfigError lists every problem found in the config of a stage.
+type ConfigError struct {
+	Stage    string
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid config for stage %s:\n  %s", e.Stage, strings.Join(e.Problems, "\n  "))
+}
+
+// BASE_ONLY_KEYS are read from deploy.toml alone, before any stage is
+// loaded, so a stage file must not set them.
+var BASE_ONLY_KEYS = []string{"history_file", "secrets_key_file"}
+
+// validateConfig checks a decoded config without connecting anywhere.
+// layers are the files it was merged from, used to say where unknown keys
+// come from.
+func validateConfig(conf *Config, md toml.MetaData, layers []configLayer) []string {
+	problems := []string{}
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, key := range md.Undecoded() {
+		add("%s: unknown key %s", keySource(key, layers), key)
+	}
+	for _, l := range layers {
+		if l.Path == PATH_CONFIG {
+			continue
+		}
+		for _, key := range BASE_ONLY_KEYS {
+			if hasKey(l.Table, toml.Key{key}) {
+				add("%s: %s can only be set in %s", l.Path, key, PATH_CONFIG)
+			}
+		}
+	}
+
+	if conf.GitRepoURL == "" {
+		add("git_repo_url is required")
+	}
+	if conf.DeployTo == "" {
+		add("deploy_to is required")
+	} else if !path.IsAbs(conf.DeployTo) {
+		add("deploy_to must be an absolute path, got %q", conf.DeployTo)
+	}
+	if conf.DeployCachedCopy == "" {
+		add("deploy_cached_copy is required")
+	}
+	if conf.DeployKeepReleases < 1 {
+		add("deploy_keep_releases must be at least 1, got %d", conf.DeployKeepReleases)
+	}
+	if conf.DeployMinFreeSpace < 0 {
+		add("deploy_min_free_space must not be negative, got %d", conf.DeployMinFreeSpace)
+	}
+
+	for _, v := range []struct{ name, value string }{
+		{"command_timeout", conf.CommandTimeout},
+		{"deploy_timeout", conf.DeployTimeout},
+		{"ssh_timeout", conf.SSHTimeout},
+	} {
+		if v.value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v.value); err != nil || d < 0 {
+			add("%s must be a duration such as \"10m\", got %q", v.name, v.value)
+		}
+	}
+
+	for _, v := range []struct {
+		name  string
+		paths []string
+	}{
+		{"shared_dirs", conf.SharedDirs},
+		{"shared_files", conf.SharedFiles},
+		{"writable_dirs", conf.WritableDirs},
+	} {
+		for _, p := range v.paths {
+			if !isInsideRelease(p) {
+				add("%s: %q must be a relative path inside the release", v.name, p)
+			}
+		}
+	}
+
+	if len(conf.Servers) == 0 {
+		add("at least one server is required")
+	}
+	for i, s := range conf.Servers {
+		if s.Host == "" {
+			add("servers[%d]: host is required", i)
+		}
+		switch s.Transport {
+		case "", TRANSPORT_SSH, TRANSPORT_LOCAL:
+		default:
+			add("servers[%d]: transport must be %q or %q, got %q", i, TRANSPORT_SSH, TRANSPORT_LOCAL, s.Transport)
+		}
+	}
+
+	return problems
+}
+
+// isInsideRelease reports whether p stays inside the directory it is
+// joined to, which for writable_dirs is the release or shared dir.
+func isInsideRelease(p string) bool {
+	if p == "" || path.IsAbs(p) {
+		return false
+	}
+	p = path.Clean(p)
+	return p != "." && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// keySource returns the path of the last layer that sets key.
+func keySource(key toml.Key, layers []configLayer) string {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if hasKey(layers[i].Table, key) {
+			return layers[i].Path
+		}
+	}
+	return PATH_CONFIG
+}
+
+func hasKey(v interface{}, key toml.Key) bool {
+	if len(key) == 0 {
+		return true
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, k := range []string{key[0], key[0] + "+"} {
+			if child, ok := t[k]; ok && hasKey(child, key[1:]) {
+				return true
+			}
+		}
+	case []map[string]interface{}:
+		for _, child := range t {
+			if hasKey(child, key) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range t {
+			if hasKey(child, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func capConfigValidate(c *cli.Context) error {
+	stage := c.GlobalString("stage")
+	if _, err := newConfig(stage); err != nil {
+		return exitError(EXIT_CONFIG, err)
+	}
+	color.Green("config for stage %s is valid\n", stage)
+	return nil
+}